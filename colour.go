@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+const (
+	BACKGROUND_ARG = "background="
+)
+
+var (
+	COLOUR_NAMES = map[string]color.RGBA{
+		"white": {R: 255, G: 255, B: 255, A: 255},
+		"black": {R: 0, G: 0, B: 0, A: 255},
+		"grey":  {R: 128, G: 128, B: 128, A: 255},
+		"gray":  {R: 128, G: 128, B: 128, A: 255},
+	}
+)
+
+//
+// Parse a colour. A name (white, black, grey) or hex RRGGBB or RGB with an optional leading '#'.
+//
+func validColour(name, colour string) (color.RGBA, error) {
+	c := strings.ToLower(strings.TrimSpace(colour))
+	named, ok := COLOUR_NAMES[c]
+	if ok {
+		return named, nil
+	}
+	hex := strings.TrimPrefix(c, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err == nil {
+			return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+		}
+	}
+	return color.RGBA{}, fmt.Errorf("%s%s is invalid. Use white, black, grey or a hex colour RRGGBB", name, colour)
+}
+
+func colourString(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+//
+// Composite the image onto the background colour. The result is opaque.
+// Used when the output format (jpg) has no alpha. Otherwise transparent areas are black.
+//
+func flattenAlpha(img *image.RGBA, bg color.RGBA) *image.RGBA {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		p := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			i := x * 4
+			a := int(p[i+3])
+			if a == 255 {
+				continue
+			}
+			// The pixels are alpha pre-multiplied so the background is added in proportion to the transparency
+			p[i] = uint8(int(p[i]) + (int(bg.R)*(255-a)+127)/255)
+			p[i+1] = uint8(int(p[i+1]) + (int(bg.G)*(255-a)+127)/255)
+			p[i+2] = uint8(int(p[i+2]) + (int(bg.B)*(255-a)+127)/255)
+			p[i+3] = 255
+		}
+	}
+	return img
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+)
+
+const (
+	GREY_ARG = "grey="
+
+	GREY_RGB  = "rgb"
+	GREY_KEEP = "keep"
+
+	COLOUR_MODEL_RGB  = "rgb"
+	COLOUR_MODEL_GREY = "grey"
+	COLOUR_MODEL_CMYK = "cmyk"
+)
+
+var (
+	// Adobe APP14 segment. Version 100, no flags, transform 0 (CMYK)
+	ADOBE_CMYK_SEGMENT = []byte{0xFF, 0xEE, 0x00, 0x0E, 'A', 'd', 'o', 'b', 'e', 0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00}
+)
+
+//
+// grey=rgb  Grey sources are saved as RGB jpg files. This is the default.
+// grey=keep Grey sources are saved as single channel (grey) jpg files. They are about a third smaller.
+//
+func validGrey(grey string) (string, error) {
+	g := strings.ToLower(strings.TrimSpace(grey))
+	switch g {
+	case GREY_RGB, GREY_KEEP:
+		return g, nil
+	}
+	return "", fmt.Errorf("grey=%s is invalid. Use %s or %s", grey, GREY_RGB, GREY_KEEP)
+}
+
+//
+// The colour model of the source image from the image header. The image is not decoded.
+// Returns rgb, grey or cmyk.
+//
+func sourceColourModel(source string) string {
+	f, err := openImage(source)
+	if err != nil {
+		return COLOUR_MODEL_RGB
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return COLOUR_MODEL_RGB
+	}
+	switch cfg.ColorModel {
+	case color.GrayModel, color.Gray16Model:
+		return COLOUR_MODEL_GREY
+	case color.CMYKModel:
+		return COLOUR_MODEL_CMYK
+	}
+	return COLOUR_MODEL_RGB
+}
+
+//
+// Decode an image file.
+//
+// CMYK jpg files written by Adobe applications have an APP14 segment and the values are inverted (255 is no ink).
+// The jpeg package handles these. CMYK jpg files without an APP14 segment are not inverted and the jpeg package
+// cannot decode them. For these an APP14 segment is added and the decoded values are inverted back.
+//
+func decodeImage(f io.ReadSeeker) (image.Image, error) {
+	img, _, err := image.Decode(f)
+	if err == nil {
+		return img, nil
+	}
+	if _, ok := err.(jpeg.UnsupportedError); !ok || !strings.Contains(err.Error(), "APP14") {
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var soi [2]byte
+	_, err = io.ReadFull(f, soi[:])
+	if err != nil {
+		return nil, err
+	}
+	img, err = jpeg.Decode(io.MultiReader(bytes.NewReader(soi[:]), bytes.NewReader(ADOBE_CMYK_SEGMENT), f))
+	if err != nil {
+		return nil, err
+	}
+	cmyk, ok := img.(*image.CMYK)
+	if ok {
+		for i := range cmyk.Pix {
+			cmyk.Pix[i] = 255 - cmyk.Pix[i]
+		}
+	}
+	return img, nil
+}
+
+//
+// The image to encode. With grey=keep a thumbnail of a grey source is converted to a single channel image.
+//
+func outputImage(img *image.RGBA, info *ThumbInfo, opts *ThumbOptions) image.Image {
+	if opts.grey != GREY_KEEP || info == nil || info.colourModel != COLOUR_MODEL_GREY {
+		return img
+	}
+	b := img.Bounds()
+	grey := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	i := 0
+	forEachPixel(img, func(p []uint8) {
+		// Grey sources have R = G = B unless a coloured watermark has been drawn
+		grey.Pix[i] = clampByte(0.299*float32(p[0]) + 0.587*float32(p[1]) + 0.114*float32(p[2]))
+		i++
+	})
+	return grey
+}
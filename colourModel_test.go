@@ -0,0 +1,149 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//
+// Write an 8 x 8 baseline CMYK jpg with a single colour. Each block only has a DC value.
+// If adobe is true an APP14 segment is added and the values are stored inverted (as Adobe applications do).
+//
+func writeTestCMYKJpeg(t *testing.T, fileName string, cmyk [4]uint8, adobe bool) {
+	out := []byte{0xFF, 0xD8}
+	if adobe {
+		out = append(out, ADOBE_CMYK_SEGMENT...)
+	}
+	// Quantisation table of 1s
+	dqt := []byte{0xFF, 0xDB, 0x00, 0x43, 0x00}
+	for i := 0; i < 64; i++ {
+		dqt = append(dqt, 1)
+	}
+	out = append(out, dqt...)
+	// 8 bit, 8 x 8, 4 components with no sub sampling
+	out = append(out, 0xFF, 0xC0, 0x00, 0x14, 0x08, 0x00, 0x08, 0x00, 0x08, 0x04)
+	for c := byte(1); c <= 4; c++ {
+		out = append(out, c, 0x11, 0x00)
+	}
+	// DC table. Categories 0..11 all have 4 bit codes (0000..1011)
+	out = append(out, 0xFF, 0xC4, 0x00, 0x1F, 0x00, 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	out = append(out, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+	// AC table. Only end of block (code 00)
+	out = append(out, 0xFF, 0xC4, 0x00, 0x14, 0x10, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x00)
+	out = append(out, 0xFF, 0xDA, 0x00, 0x0E, 0x04, 1, 0x00, 2, 0x00, 3, 0x00, 4, 0x00, 0x00, 0x3F, 0x00)
+
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v&(1<<i) != 0)
+		}
+	}
+	for _, v := range cmyk {
+		if adobe {
+			v = 255 - v
+		}
+		// A DC only block of value v has a DC coefficient of (v - 128) * 8
+		dc := (int(v) - 128) * 8
+		cat, mag := 0, absInt(dc)
+		for mag > 0 {
+			cat++
+			mag >>= 1
+		}
+		put(cat, 4)
+		if dc < 0 {
+			dc += (1 << cat) - 1
+		}
+		put(dc, cat)
+		put(0, 2)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, true)
+	}
+	for i := 0; i < len(bits); i += 8 {
+		b := byte(0)
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 0x80 >> j
+			}
+		}
+		out = append(out, b)
+		if b == 0xFF {
+			out = append(out, 0x00)
+		}
+	}
+	out = append(out, 0xFF, 0xD9)
+	err := os.WriteFile(fileName, out, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func near(c color.RGBA, r, g, b uint8) bool {
+	return absInt(int(c.R)-int(r)) <= 2 && absInt(int(c.G)-int(g)) <= 2 && absInt(int(c.B)-int(b)) <= 2
+}
+
+func TestDecodeCMYK(t *testing.T) {
+	dir := t.TempDir()
+	red := [4]uint8{0, 255, 255, 0}
+	for i, adobe := range []bool{true, false} {
+		fileName := filepath.Join(dir, "cmyk.jpg")
+		writeTestCMYKJpeg(t, fileName, red, adobe)
+		if sourceColourModel(fileName) != COLOUR_MODEL_CMYK {
+			t.Fatalf("Failed: id:%03d colour model:%s", i*3+1, sourceColourModel(fileName))
+		}
+		img, _, err := NewImageLimits(0, 0, 0).decode(fileName, 1)
+		if err != nil {
+			t.Fatalf("Failed: id:%03d adobe:%t %s", i*3+2, adobe, err.Error())
+		}
+		c := toRGBA(img).RGBAAt(4, 4)
+		if !near(c, 255, 0, 0) {
+			t.Fatalf("Failed: id:%03d adobe:%t colour:%v", i*3+3, adobe, c)
+		}
+	}
+}
+
+func TestGreyOutput(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "grey.jpg")
+	grey := image.NewGray(image.Rect(0, 0, 40, 20))
+	for i := range grey.Pix {
+		grey.Pix[i] = uint8(i % 200)
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpeg.Encode(f, grey, nil)
+	f.Close()
+
+	opts := NewThumbOptions(10)
+	img, info, err := createThumbImage(NewPicture(fileName, false), "t.jpg", opts, false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.colourModel != COLOUR_MODEL_GREY {
+		t.Fatalf("Failed: id:001 colour model:%s", info.colourModel)
+	}
+	if _, ok := outputImage(img, info, opts).(*image.RGBA); !ok {
+		t.Fatalf("Failed: id:002 grey=rgb should output RGBA")
+	}
+	opts.grey = GREY_KEEP
+	out, ok := outputImage(img, info, opts).(*image.Gray)
+	if !ok {
+		t.Fatalf("Failed: id:003 grey=keep should output Gray")
+	}
+	if out.Bounds() != img.Bounds() || out.GrayAt(3, 3).Y != img.RGBAAt(3, 3).G {
+		t.Fatalf("Failed: id:004 grey output does not match")
+	}
+	info.colourModel = COLOUR_MODEL_RGB
+	if _, ok := outputImage(img, info, opts).(*image.RGBA); !ok {
+		t.Fatalf("Failed: id:005 rgb source should output RGBA")
+	}
+	_, err = validGrey("blue")
+	if err == nil {
+		t.Fatalf("Failed: id:006 grey=blue should be invalid")
+	}
+}
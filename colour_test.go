@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestValidColour(t *testing.T) {
+	assertColour(t, "001", "white", color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	assertColour(t, "002", "#102030", color.RGBA{R: 16, G: 32, B: 48, A: 255})
+	assertColour(t, "003", "ABCDEF", color.RGBA{R: 171, G: 205, B: 239, A: 255})
+	assertColour(t, "004", "#f00", color.RGBA{R: 255, G: 0, B: 0, A: 255})
+	_, err := validColour("background=", "purple")
+	if err == nil {
+		t.Fatalf("Failed: id:005 purple should fail")
+	}
+	_, err = validColour("background=", "#12345g")
+	if err == nil {
+		t.Fatalf("Failed: id:006 #12345g should fail")
+	}
+}
+
+func TestFlattenAlpha(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	img.SetRGBA(0, 0, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+	img.SetRGBA(1, 0, color.RGBA{})
+	img.SetRGBA(2, 0, color.RGBA{R: 100, G: 0, B: 0, A: 128})
+	flattenAlpha(img, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	expected := []color.RGBA{{R: 10, G: 20, B: 30, A: 255}, {R: 255, G: 255, B: 255, A: 255}, {R: 227, G: 127, B: 127, A: 255}}
+	for x, e := range expected {
+		if img.RGBAAt(x, 0) != e {
+			t.Fatalf("Failed: id:001 pixel %d expected:%v actual:%v", x, e, img.RGBAAt(x, 0))
+		}
+	}
+}
+
+func assertColour(t *testing.T, id, colour string, expected color.RGBA) {
+	c, err := validColour("background=", colour)
+	if err != nil {
+		t.Fatalf("Failed: id:%s error:%s", id, err.Error())
+	}
+	if c != expected {
+		t.Fatalf("Failed: id:%s expected:%v actual:%v", id, expected, c)
+	}
+}
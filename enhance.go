@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const (
+	ENHANCE_ARG = "enhance="
+
+	ENHANCE_OFF           = "off"
+	ENHANCE_AUTO          = "auto"
+	ENHANCE_CONTRAST      = "contrast"
+	ENHANCE_WHITE_BALANCE = "whitebalance"
+
+	ENHANCE_CLIP         = 0.005 // Fraction of the darkest and lightest pixels ignored by auto levels
+	ENHANCE_CONTRAST_STD = 60.0  // Target standard deviation of the luminance for auto contrast
+	ENHANCE_CONTRAST_MAX = 1.5   // Maximum contrast increase
+	ENHANCE_WB_MAX       = 2.0   // Maximum white balance gain (or 1 / max reduction)
+)
+
+//
+// Tone and colour adjustments applied to the thumbnail. Originals are never changed.
+//
+//    levels       Stretch the luminance so the darkest pixels are black and the lightest are white.
+//    contrast     Increase the spread of the luminance around the mean.
+//    whiteBalance Remove a colour cast by making the average colour grey (grey world).
+//
+type Enhance struct {
+	levels       bool
+	contrast     bool
+	whiteBalance bool
+}
+
+//
+// Parse a comma separated list. For example 'auto' or 'auto,contrast,whitebalance'. 'off' is no enhancement.
+//
+func validEnhance(enhance string) (Enhance, error) {
+	e := Enhance{}
+	for _, v := range strings.Split(strings.ToLower(enhance), ",") {
+		switch strings.TrimSpace(v) {
+		case ENHANCE_OFF, "":
+		case ENHANCE_AUTO:
+			e.levels = true
+		case ENHANCE_CONTRAST:
+			e.contrast = true
+		case ENHANCE_WHITE_BALANCE, "wb":
+			e.whiteBalance = true
+		default:
+			return Enhance{}, fmt.Errorf("enhance=%s is invalid. Use %s or a list of %s, %s and %s", enhance, ENHANCE_OFF, ENHANCE_AUTO, ENHANCE_CONTRAST, ENHANCE_WHITE_BALANCE)
+		}
+	}
+	return e, nil
+}
+
+func (e Enhance) String() string {
+	list := make([]string, 0)
+	if e.levels {
+		list = append(list, ENHANCE_AUTO)
+	}
+	if e.contrast {
+		list = append(list, ENHANCE_CONTRAST)
+	}
+	if e.whiteBalance {
+		list = append(list, ENHANCE_WHITE_BALANCE)
+	}
+	if len(list) == 0 {
+		return ENHANCE_OFF
+	}
+	return strings.Join(list, ",")
+}
+
+//
+// Apply the enhancements to the (already scaled) image. The image is updated and returned.
+// White balance is applied first so auto levels sees the corrected colours.
+//
+func (e Enhance) apply(img *image.RGBA) *image.RGBA {
+	if e.whiteBalance {
+		whiteBalance(img)
+	}
+	if e.levels {
+		autoLevels(img)
+	}
+	if e.contrast {
+		autoContrast(img)
+	}
+	return img
+}
+
+func whiteBalance(img *image.RGBA) {
+	var sum [3]float64
+	count := 0
+	forEachPixel(img, func(p []uint8) {
+		if p[3] == 255 {
+			sum[0] += float64(p[0])
+			sum[1] += float64(p[1])
+			sum[2] += float64(p[2])
+			count++
+		}
+	})
+	if count == 0 || sum[0] == 0 || sum[1] == 0 || sum[2] == 0 {
+		return
+	}
+	grey := (sum[0] + sum[1] + sum[2]) / 3
+	var luts [3][256]uint8
+	for c := 0; c < 3; c++ {
+		gain := math.Min(math.Max(grey/sum[c], 1/ENHANCE_WB_MAX), ENHANCE_WB_MAX)
+		for v := 0; v < 256; v++ {
+			luts[c][v] = clampByte(float32(float64(v) * gain))
+		}
+	}
+	applyLuts(img, luts)
+}
+
+func autoLevels(img *image.RGBA) {
+	hist, count := lumaHistogram(img)
+	if count == 0 {
+		return
+	}
+	clip := int(float64(count) * ENHANCE_CLIP)
+	lo, hi := 0, 255
+	for n := 0; lo < 255; lo++ {
+		n += hist[lo]
+		if n > clip {
+			break
+		}
+	}
+	for n := 0; hi > 0; hi-- {
+		n += hist[hi]
+		if n > clip {
+			break
+		}
+	}
+	if hi <= lo {
+		return
+	}
+	var lut [256]uint8
+	for v := 0; v < 256; v++ {
+		lut[v] = clampByte(float32(float64(v-lo) * 255 / float64(hi-lo)))
+	}
+	applyLuts(img, [3][256]uint8{lut, lut, lut})
+}
+
+func autoContrast(img *image.RGBA) {
+	hist, count := lumaHistogram(img)
+	if count == 0 {
+		return
+	}
+	mean := 0.0
+	for v, n := range hist {
+		mean += float64(v * n)
+	}
+	mean /= float64(count)
+	variance := 0.0
+	for v, n := range hist {
+		variance += float64(n) * (float64(v) - mean) * (float64(v) - mean)
+	}
+	std := math.Sqrt(variance / float64(count))
+	if std < 1 {
+		return
+	}
+	factor := math.Min(math.Max(ENHANCE_CONTRAST_STD/std, 1), ENHANCE_CONTRAST_MAX)
+	if factor == 1 {
+		return
+	}
+	var lut [256]uint8
+	for v := 0; v < 256; v++ {
+		lut[v] = clampByte(float32(mean + (float64(v)-mean)*factor))
+	}
+	applyLuts(img, [3][256]uint8{lut, lut, lut})
+}
+
+//
+// Histogram of the luminance of the opaque pixels.
+//
+func lumaHistogram(img *image.RGBA) ([256]int, int) {
+	var hist [256]int
+	count := 0
+	forEachPixel(img, func(p []uint8) {
+		if p[3] == 255 {
+			hist[clampByte(0.299*float32(p[0])+0.587*float32(p[1])+0.114*float32(p[2]))]++
+			count++
+		}
+	})
+	return hist, count
+}
+
+//
+// Map the R, G and B values of the opaque pixels using a look up table for each channel.
+//
+func applyLuts(img *image.RGBA, luts [3][256]uint8) {
+	forEachPixel(img, func(p []uint8) {
+		if p[3] == 255 {
+			p[0] = luts[0][p[0]]
+			p[1] = luts[1][p[1]]
+			p[2] = luts[2][p[2]]
+		}
+	})
+}
+
+func forEachPixel(img *image.RGBA, fn func(p []uint8)) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx()*4; x += 4 {
+			fn(row[x : x+4])
+		}
+	}
+}
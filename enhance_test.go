@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestValidEnhance(t *testing.T) {
+	e, err := validEnhance("auto, Contrast,wb")
+	if err != nil || !e.levels || !e.contrast || !e.whiteBalance {
+		t.Fatalf("Failed: id:001 %v %v", e, err)
+	}
+	if e.String() != "auto,contrast,whitebalance" {
+		t.Fatalf("Failed: id:002 %s", e.String())
+	}
+	e, err = validEnhance("off")
+	if err != nil || e != (Enhance{}) || e.String() != "off" {
+		t.Fatalf("Failed: id:003 %v %v", e, err)
+	}
+	_, err = validEnhance("auto,magic")
+	if err == nil {
+		t.Fatalf("Failed: id:004 magic should fail")
+	}
+}
+
+func TestEnhanceApply(t *testing.T) {
+	// A flat grey image from 100 to 150
+	img := enhanceTestImage(func(i int) color.RGBA {
+		v := uint8(100 + i%51)
+		return color.RGBA{R: v, G: v, B: v, A: 255}
+	})
+	Enhance{levels: true}.apply(img)
+	lo, hi := lumaRange(img)
+	if lo != 0 || hi != 255 {
+		t.Fatalf("Failed: id:001 auto levels range:%d..%d", lo, hi)
+	}
+
+	img = enhanceTestImage(func(i int) color.RGBA {
+		v := uint8(100 + i%51)
+		return color.RGBA{R: v, G: v, B: v, A: 255}
+	})
+	Enhance{contrast: true}.apply(img)
+	lo, hi = lumaRange(img)
+	if lo >= 100 || hi <= 150 {
+		t.Fatalf("Failed: id:002 auto contrast range:%d..%d", lo, hi)
+	}
+
+	// A blue cast
+	img = enhanceTestImage(func(i int) color.RGBA {
+		return color.RGBA{R: 80, G: 100, B: 150, A: 255}
+	})
+	Enhance{whiteBalance: true}.apply(img)
+	p := img.RGBAAt(0, 0)
+	if absInt(int(p.R)-int(p.B)) > 2 || absInt(int(p.G)-int(p.B)) > 2 {
+		t.Fatalf("Failed: id:003 white balance:%v", p)
+	}
+}
+
+func enhanceTestImage(fn func(i int) color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 51, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 51; x++ {
+			img.SetRGBA(x, y, fn(y*51+x))
+		}
+	}
+	return img
+}
+
+func lumaRange(img *image.RGBA) (int, int) {
+	lo, hi := 255, 0
+	forEachPixel(img, func(p []uint8) {
+		lo = minInt(lo, int(p[0]))
+		hi = maxInt(hi, int(p[0]))
+	})
+	return lo, hi
+}
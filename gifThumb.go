@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	ANIMATE_ARG     = "animate="
+	MAX_FRAMES_ARG  = "maxframes="
+	MAX_ANIM_KB_ARG = "maxanimkb="
+
+	THUMB_ANIM_TYPE = ".gif"
+
+	GIF_EXTENSION  = 0x21
+	GIF_IMAGE      = 0x2C
+	GIF_TRAILER    = 0x3B
+	GIF_HEADER_LEN = 13
+)
+
+//
+// Create an animated GIF thumbnail from an animated GIF.
+// Each frame is scaled separately and keeps its position, delay and disposal.
+//
+// nil data (and no error) is returned if a static (jpg) thumbnail should be created instead:
+//    The GIF has only one frame.
+//    The GIF has more than opts.maxFrames frames.
+//    The encoded thumbnail is larger than opts.maxAnimKb.
+//    There is a watermark. It cannot be drawn using the frame palettes.
+//    The frames cannot be counted. The static thumbnail decode reports any error.
+//    frames * width * height is more than the pixel limit. Every frame can be the full size of the GIF.
+//
+// The frames are counted before the GIF is decoded.
+//
+func createAnimatedThumb(pic *Picture, thumbName string, opts *ThumbOptions, verbose bool) ([]byte, *ThumbInfo, error) {
+	if opts.watermark != nil {
+		if verbose {
+			logServer("INFO", fmt.Sprintf("Watermark. Static thumbnail used for:%s", pic.source), nil)
+		}
+		return nil, nil, nil
+	}
+	cfg, err := opts.limits.check(pic.source)
+	if err != nil {
+		logServer("DECODE", pic.source, err)
+		return nil, nil, err
+	}
+	f, err := os.Open(pic.source)
+	if err != nil {
+		logServer("OPEN", pic.source, err)
+		return nil, nil, err
+	}
+	defer f.Close()
+	frames, err := gifFrameCount(f, opts.maxFrames+1)
+	if err != nil || frames < 2 {
+		return nil, nil, nil
+	}
+	if frames > opts.maxFrames {
+		if verbose {
+			logServer("INFO", fmt.Sprintf("Frames exceed maxframes:%d. Static thumbnail used for:%s", opts.maxFrames, pic.source), nil)
+		}
+		return nil, nil, nil
+	}
+	pixels := int64(frames) * int64(cfg.Width) * int64(cfg.Height)
+	if opts.limits.maxPixels > 0 && pixels > opts.limits.maxPixels {
+		if verbose {
+			logServer("INFO", fmt.Sprintf("Frames:%d of %dx%d exceed maxpixels:%d. Static thumbnail used for:%s", frames, cfg.Width, cfg.Height, opts.limits.maxPixels, pic.source), nil)
+		}
+		return nil, nil, nil
+	}
+	opts.limits.budget.acquire(pixels)
+	defer opts.limits.budget.release(pixels)
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		logServer("OPEN", pic.source, err)
+		return nil, nil, err
+	}
+	src, err := gif.DecodeAll(f)
+	if err != nil {
+		logServer("DECODE", pic.source, err)
+		return nil, nil, err
+	}
+	if len(src.Image) < 2 || len(src.Image) > opts.maxFrames {
+		return nil, nil, nil
+	}
+
+	w, h := src.Config.Width, src.Config.Height
+	if w < 1 || h < 1 {
+		w, h = src.Image[0].Bounds().Max.X, src.Image[0].Bounds().Max.Y
+	}
+	info := &ThumbInfo{frames: len(src.Image)}
+	crop := opts.cropRect(w, h)
+	if crop.Dx() != w || crop.Dy() != h {
+		info.crop = crop
+	}
+	tw, th, noUpscale := opts.effectiveSize(w, h)
+	info.width, info.height, info.noUpscale = tw, th, noUpscale
+
+	if verbose {
+		logServer("INFO", fmt.Sprintf("W:%d H:%d Frames:%d Fit:%s in:%s: out:%s", tw, th, len(src.Image), opts.fit, pic.source, thumbName), nil)
+	}
+
+	dst := &gif.GIF{
+		Delay:           src.Delay,
+		Disposal:        src.Disposal,
+		LoopCount:       src.LoopCount,
+		BackgroundIndex: src.BackgroundIndex,
+		Config:          image.Config{ColorModel: src.Config.ColorModel, Width: tw, Height: th},
+	}
+	sx := float64(tw) / float64(crop.Dx())
+	sy := float64(th) / float64(crop.Dy())
+	for _, frame := range src.Image {
+		dst.Image = append(dst.Image, scaleFrame(frame, crop, sx, sy, tw, th, opts))
+	}
+
+	ew := NewEncodedWriter(500)
+	err = gif.EncodeAll(ew, dst)
+	if err != nil {
+		logServer("ENCODE", pic.source, err)
+		return nil, nil, err
+	}
+	if len(ew.Bytes()) > opts.maxAnimKb*1024 {
+		if verbose {
+			logServer("INFO", fmt.Sprintf("Size:%d bytes exceeds maxanimkb:%d. Static thumbnail used for:%s", len(ew.Bytes()), opts.maxAnimKb, pic.source), nil)
+		}
+		return nil, nil, nil
+	}
+	return ew.Bytes(), info, nil
+}
+
+//
+// Count the image descriptors in a GIF without decoding the frames. Counting stops at max.
+// The extension blocks and the image data are skipped using their sub-block sizes.
+//
+func gifFrameCount(r io.Reader, max int) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, GIF_HEADER_LEN)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "GIF" {
+		return 0, fmt.Errorf("not a gif")
+	}
+	// Global colour table
+	err = gifSkipColourTable(br, header[10])
+	if err != nil {
+		return 0, err
+	}
+	frames := 0
+	for frames < max {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case GIF_TRAILER:
+			return frames, nil
+		case GIF_EXTENSION:
+			_, err = br.ReadByte()
+			if err == nil {
+				err = gifSkipSubBlocks(br)
+			}
+		case GIF_IMAGE:
+			desc := make([]byte, 9)
+			_, err = io.ReadFull(br, desc)
+			if err == nil {
+				err = gifSkipColourTable(br, desc[8])
+			}
+			if err == nil {
+				// LZW minimum code size then the image data
+				_, err = br.ReadByte()
+			}
+			if err == nil {
+				err = gifSkipSubBlocks(br)
+			}
+			frames++
+		default:
+			return 0, fmt.Errorf("gif block 0x%02x is invalid", b)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return frames, nil
+}
+
+func gifSkipColourTable(br *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := br.Discard(3 * (1 << (int(flags&0x07) + 1)))
+	return err
+}
+
+func gifSkipSubBlocks(br *bufio.Reader) error {
+	for {
+		n, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		_, err = br.Discard(int(n))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//
+// Scale the part of the frame inside crop by sx, sy. The frame keeps its (scaled) position and its palette.
+//
+func scaleFrame(frame *image.Paletted, crop image.Rectangle, sx, sy float64, tw, th int, opts *ThumbOptions) *image.Paletted {
+	transparent := -1
+	for i, c := range frame.Palette {
+		_, _, _, a := c.RGBA()
+		if a == 0 {
+			transparent = i
+			break
+		}
+	}
+	fb := frame.Bounds().Intersect(crop)
+	if fb.Empty() {
+		// Nothing to draw. A frame cannot be empty so draw one transparent pixel
+		out := image.NewPaletted(image.Rect(0, 0, 1, 1), frame.Palette)
+		out.SetColorIndex(0, 0, uint8(maxInt(transparent, 0)))
+		return out
+	}
+
+	x0 := minInt(int(math.Floor(float64(fb.Min.X-crop.Min.X)*sx)), tw-1)
+	y0 := minInt(int(math.Floor(float64(fb.Min.Y-crop.Min.Y)*sy)), th-1)
+	x1 := maxInt(minInt(int(math.Ceil(float64(fb.Max.X-crop.Min.X)*sx)), tw), x0+1)
+	y1 := maxInt(minInt(int(math.Ceil(float64(fb.Max.Y-crop.Min.Y)*sy)), th), y0+1)
+	scaled := resample(subImage(frame, fb), x1-x0, y1-y0, opts.filter)
+	scaled = unsharpMask(scaled, opts.sharpen)
+
+	out := image.NewPaletted(image.Rect(x0, y0, x1, y1), frame.Palette)
+	cache := make(map[color.RGBA]uint8)
+	for y := 0; y < y1-y0; y++ {
+		for x := 0; x < x1-x0; x++ {
+			p := scaled.Pix[y*scaled.Stride+x*4:]
+			if p[3] < 128 && transparent >= 0 {
+				out.SetColorIndex(x0+x, y0+y, uint8(transparent))
+				continue
+			}
+			c := color.RGBA{R: p[0], G: p[1], B: p[2], A: 255}
+			if p[3] > 0 && p[3] < 255 {
+				// Remove the alpha pre-multiplication
+				c.R = uint8(minInt(int(p[0])*255/int(p[3]), 255))
+				c.G = uint8(minInt(int(p[1])*255/int(p[3]), 255))
+				c.B = uint8(minInt(int(p[2])*255/int(p[3]), 255))
+			}
+			idx, ok := cache[c]
+			if !ok {
+				idx = uint8(frame.Palette.Index(c))
+				cache[c] = idx
+			}
+			out.SetColorIndex(x0+x, y0+y, idx)
+		}
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateAnimatedThumb(t *testing.T) {
+	dir := t.TempDir()
+	animFile := writeTestGif(t, dir, "anim.gif", 3)
+	stillFile := writeTestGif(t, dir, "still.gif", 1)
+	opts := NewThumbOptions(10)
+
+	data, info, err := createAnimatedThumb(NewPicture(animFile, true), "", opts, false)
+	if err != nil || data == nil {
+		t.Fatalf("Failed: id:001 animated thumbnail expected. error:%v", err)
+	}
+	if info.frames != 3 || info.width != 20 || info.height != 10 {
+		t.Fatalf("Failed: id:002 info frames:%d size:%dx%d", info.frames, info.width, info.height)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed: id:003 decode error:%s", err.Error())
+	}
+	if len(g.Image) != 3 || g.Config.Width != 20 || g.Config.Height != 10 {
+		t.Fatalf("Failed: id:004 frames:%d size:%dx%d", len(g.Image), g.Config.Width, g.Config.Height)
+	}
+	for i := range g.Image {
+		if g.Delay[i] != (i+1)*10 || g.Disposal[i] != gif.DisposalBackground {
+			t.Fatalf("Failed: id:005 frame:%d delay:%d disposal:%d", i, g.Delay[i], g.Disposal[i])
+		}
+	}
+	// The second frame is the right half of the image at 20,0. Scaled it is 10x10 at 10,0
+	if g.Image[1].Bounds() != image.Rect(10, 0, 20, 10) {
+		t.Fatalf("Failed: id:006 frame bounds:%s", g.Image[1].Bounds())
+	}
+
+	data, _, err = createAnimatedThumb(NewPicture(stillFile, true), "", opts, false)
+	if err != nil || data != nil {
+		t.Fatalf("Failed: id:007 single frame should use a static thumbnail. error:%v", err)
+	}
+	opts.maxFrames = 2
+	data, _, err = createAnimatedThumb(NewPicture(animFile, true), "", opts, false)
+	if err != nil || data != nil {
+		t.Fatalf("Failed: id:008 too many frames should use a static thumbnail. error:%v", err)
+	}
+	// 3 frames of 40x20 need 2400 pixels. The first frame (800 pixels) is used for a static thumbnail
+	opts = NewThumbOptions(10)
+	opts.limits = NewImageLimits(2000, 0, 2000)
+	data, _, err = createAnimatedThumb(NewPicture(animFile, true), "", opts, false)
+	if err != nil || data != nil {
+		t.Fatalf("Failed: id:009 frames over maxpixels should use a static thumbnail. error:%v", err)
+	}
+	_, _, err = createThumbImage(NewPicture(animFile, true), "", opts, false, false, 0)
+	if err != nil {
+		t.Fatalf("Failed: id:011 the static thumbnail should be created. error:%v", err)
+	}
+	// A truncated gif. The header can be read but the frames cannot be counted. It is left to the static decode
+	anim, err := os.ReadFile(animFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badFile := filepath.Join(dir, "bad.gif")
+	os.WriteFile(badFile, anim[:len(anim)/2], 0644)
+	data, _, err = createAnimatedThumb(NewPicture(badFile, true), "", NewThumbOptions(10), false)
+	if err != nil || data != nil {
+		t.Fatalf("Failed: id:012 a gif that cannot be counted should use a static thumbnail. error:%v", err)
+	}
+	// The watermark is drawn on a static thumbnail
+	opts = NewThumbOptions(10)
+	opts.watermark = NewWatermark("I", nil)
+	data, _, err = createAnimatedThumb(NewPicture(animFile, true), "", opts, false)
+	if err != nil || data != nil {
+		t.Fatalf("Failed: id:010 a watermark should use a static thumbnail. error:%v", err)
+	}
+}
+
+func TestGifFrameCount(t *testing.T) {
+	dir := t.TempDir()
+	animFile := writeTestGif(t, dir, "anim.gif", 3)
+	for i, max := range []int{100, 3, 2, 1} {
+		frames, err := gifFrameCount(mustOpen(t, animFile), max)
+		if err != nil || frames != minInt(3, max) {
+			t.Fatalf("Failed: id:%03d frames:%d max:%d error:%v", i+1, frames, max, err)
+		}
+	}
+	data, err := os.ReadFile(animFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gifFrameCount(bytes.NewReader(data[:len(data)/2]), 100)
+	if err == nil {
+		t.Fatalf("Failed: id:005 a truncated gif should fail")
+	}
+	_, err = gifFrameCount(bytes.NewReader([]byte("\x89PNG\r\n\x1a\n00000")), 100)
+	if err == nil {
+		t.Fatalf("Failed: id:006 a png is not a gif")
+	}
+}
+
+//
+// A 40x20 gif. The first frame is the whole image. Other frames are the left or right half.
+//
+func writeTestGif(t *testing.T, dir, name string, frames int) string {
+	palette := color.Palette{color.RGBA{}, color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}, color.RGBA{B: 255, A: 255}}
+	g := &gif.GIF{Config: image.Config{ColorModel: palette, Width: 40, Height: 20}}
+	for i := 0; i < frames; i++ {
+		r := image.Rect(0, 0, 40, 20)
+		if i > 0 {
+			r = image.Rect((i%2)*20, 0, (i%2)*20+20, 20)
+		}
+		img := image.NewPaletted(r, palette)
+		for j := range img.Pix {
+			img.Pix[j] = uint8(i%3 + 1)
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, (i+1)*10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	fileName := filepath.Join(dir, name)
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("Failed: create %s error:%s", fileName, err.Error())
+	}
+	defer f.Close()
+	err = gif.EncodeAll(f, g)
+	if err != nil {
+		t.Fatalf("Failed: encode %s error:%s", fileName, err.Error())
+	}
+	return fileName
+}
@@ -3,7 +3,6 @@ module github.com/stuartdd/thumbnails
 go 1.18
 
 require (
-	github.com/liujiawm/graphics-go v0.0.0-20200331105750-879216a3393f
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	github.com/stuartdd2/JsonParser4go/parser v0.0.0-20220729214751-7eddfb61aeda
 )
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BURST_GAP_ARG = "burstgap="
+	EVENT_GAP_ARG = "eventgap="
+	LAYOUT_ARG    = "layout="
+
+	LAYOUT_TREE   = "tree"
+	LAYOUT_EVENTS = "events"
+
+	EVENT_MASK = "%YYYY_%MM_%DD_%h_%m"
+)
+
+//
+// The time gaps used to group pictures.
+//
+//    burst A picture taken within burst of the previous picture is in the same burst.
+//    event A picture taken within event of the previous picture is in the same event.
+//
+type GroupGaps struct {
+	burst time.Duration
+	event time.Duration
+}
+
+//
+// A group of pictures taken close together. Bursts are always within an event.
+//
+type PictureGroup struct {
+	name     string
+	start    time.Time
+	end      time.Time
+	pictures []*Picture
+	bursts   [][]*Picture
+}
+
+func NewGroupGaps() *GroupGaps {
+	return &GroupGaps{burst: 2 * time.Second, event: 3 * time.Hour}
+}
+
+//
+// Read the gaps from the command line args. For example burstgap=2s eventgap=3h
+//
+func NewGroupGapsFromArgs() (*GroupGaps, error) {
+	g := NewGroupGaps()
+	var err error
+	g.burst, err = validGap(BURST_GAP_ARG, findStringArg(BURST_GAP_ARG, g.burst.String()))
+	if err != nil {
+		return nil, err
+	}
+	g.event, err = validGap(EVENT_GAP_ARG, findStringArg(EVENT_GAP_ARG, g.event.String()))
+	if err != nil {
+		return nil, err
+	}
+	return g.check()
+}
+
+//
+// A copy of the gaps with the burstgap and eventgap query parameters applied.
+//
+func (g *GroupGaps) WithQuery(r *http.Request) (*GroupGaps, error) {
+	gaps := *g
+	var err error
+	b := strings.TrimSpace(r.URL.Query().Get("burstgap"))
+	if b != "" {
+		gaps.burst, err = validGap(BURST_GAP_ARG, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e := strings.TrimSpace(r.URL.Query().Get("eventgap"))
+	if e != "" {
+		gaps.event, err = validGap(EVENT_GAP_ARG, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return gaps.check()
+}
+
+func (g GroupGaps) check() (*GroupGaps, error) {
+	if g.burst >= g.event {
+		return nil, fmt.Errorf("%s%s must be less than %s%s", BURST_GAP_ARG, g.burst, EVENT_GAP_ARG, g.event)
+	}
+	return &g, nil
+}
+
+func validGap(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s%s is invalid. Use a duration. For example 2s, 90m or 3h", name, value)
+	}
+	return d, nil
+}
+
+func validLayout(layout string) (string, error) {
+	l := strings.ToLower(strings.TrimSpace(layout))
+	switch l {
+	case LAYOUT_TREE, LAYOUT_EVENTS:
+		return l, nil
+	}
+	return "", fmt.Errorf("layout=%s is invalid. Use %s or %s", layout, LAYOUT_TREE, LAYOUT_EVENTS)
+}
+
+//
+// Group the pictures into events and bursts using the picture time. The pictures are sorted by time.
+// An event is named from the time of its first picture (EVENT_MASK).
+//
+func groupPictures(pics []*Picture, gaps *GroupGaps) []*PictureGroup {
+	sort.SliceStable(pics, func(i, j int) bool {
+		if pics[i].time.Equal(pics[j].time) {
+			return pics[i].source < pics[j].source
+		}
+		return pics[i].time.Before(pics[j].time)
+	})
+	groups := make([]*PictureGroup, 0)
+	var g *PictureGroup
+	for i, p := range pics {
+		var gap time.Duration
+		if i > 0 {
+			gap = p.time.Sub(pics[i-1].time)
+		}
+		if g == nil || gap > gaps.event {
+			g = &PictureGroup{name: subFileName(p.time, EVENT_MASK, "", ""), start: p.time}
+			groups = append(groups, g)
+		}
+		if len(g.bursts) == 0 || gap > gaps.burst {
+			g.bursts = append(g.bursts, make([]*Picture, 0))
+		}
+		g.bursts[len(g.bursts)-1] = append(g.bursts[len(g.bursts)-1], p)
+		g.pictures = append(g.pictures, p)
+		g.end = p.time
+	}
+	// Events that start in the same minute have the same name
+	names := make(map[string]int)
+	for _, g := range groups {
+		names[g.name]++
+		if names[g.name] > 1 {
+			g.name = fmt.Sprintf("%s_%d", g.name, names[g.name])
+		}
+	}
+	return groups
+}
+
+//
+// The pictures and videos in dir and its sub directories.
+//
+func picturesInDir(dir string) []*Picture {
+	pics := make([]*Picture, 0)
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		_, ok := THUMB_FILE_TYPES[strings.ToLower(filepath.Ext(p))]
+		if ok || isVideoFile(p) {
+			pics = append(pics, NewPicture(p, true))
+		}
+		return nil
+	})
+	return pics
+}
+
+//
+// The group as a json object. Picture names are relative to dir.
+//
+func (g *PictureGroup) json(dir string) string {
+	bursts := make([]string, len(g.bursts))
+	for i, b := range g.bursts {
+		names := make([]string, len(b))
+		for j, p := range b {
+			rel, _ := filepath.Rel(dir, p.source)
+			names[j] = jsonQuote(filepath.ToSlash(rel))
+		}
+		bursts[i] = "[" + strings.Join(names, ",") + "]"
+	}
+	jf := NewJsonFields()
+	jf.Add("name", g.name)
+	jf.Add("start", g.start.Format(TIME_FORMAT_MS))
+	jf.Add("end", g.end.Format(TIME_FORMAT_MS))
+	jf.AddRaw("count", fmt.Sprintf("%d", len(g.pictures)))
+	jf.AddRaw("bursts", "["+strings.Join(bursts, ",")+"]")
+	return jf.String()
+}
+
+//
+// groups/user/{user}/loc/{loc}/path/{path}?burstgap=2s&eventgap=3h
+//
+// Returns a json list of the events in the location (or path within it) and its sub directories.
+// Each event has a list of bursts. Each burst is a list of picture names in time order.
+//
+func groupsHandler(uri []string, tns *TNServer, w http.ResponseWriter, r *http.Request) *TNResp {
+	location, resp := locationFromPath(uri, tns)
+	if resp != nil {
+		return resp
+	}
+	path, isDir, resp := filePathFromPath(uri, location, tns, false)
+	if resp != nil {
+		return resp
+	}
+	if !isDir {
+		return BR("GROUPS", "not-dir", uri, nil)
+	}
+	gaps, err := tns.groupGaps.WithQuery(r)
+	if err != nil {
+		return BR("GROUPS", err.Error(), uri, err)
+	}
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i, g := range groupPictures(picturesInDir(path), gaps) {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString("\n  ")
+		sb.WriteString(g.json(path))
+	}
+	return &TNResp{returnCode: http.StatusOK, mimeType: MEDIA_JSON, resp: []byte(sb.String() + "\n]")}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGroupPictures(t *testing.T) {
+	t0 := time.Date(2022, 1, 2, 10, 11, 0, 0, time.UTC)
+	pic := func(name string, d time.Duration) *Picture {
+		return &Picture{source: "/p/" + name, time: t0.Add(d)}
+	}
+	pics := []*Picture{
+		pic("c.jpg", 1500*time.Millisecond),
+		pic("a.jpg", 0),
+		pic("b.jpg", time.Second),
+		pic("d.jpg", time.Minute),
+		pic("e.jpg", 5*time.Hour),
+		pic("f.jpg", 5*time.Hour+30*time.Second),
+	}
+	groups := groupPictures(pics, NewGroupGaps())
+	if len(groups) != 2 {
+		t.Fatalf("Failed: id:001 groups:%d", len(groups))
+	}
+	if groups[0].name != "2022_01_02_10_11" || len(groups[0].pictures) != 4 || len(groups[0].bursts) != 2 {
+		t.Fatalf("Failed: id:002 name:%s pictures:%d bursts:%d", groups[0].name, len(groups[0].pictures), len(groups[0].bursts))
+	}
+	expected := `{"name":"2022_01_02_10_11","start":"2022-01-02T10:11:00.000","end":"2022-01-02T10:12:00.000","count":4,"bursts":[["a.jpg","b.jpg","c.jpg"],["d.jpg"]]}`
+	if groups[0].json("/p") != expected {
+		t.Fatalf("Failed: id:003 json:%s", groups[0].json("/p"))
+	}
+	if groups[1].name != "2022_01_02_15_11" || len(groups[1].bursts) != 2 {
+		t.Fatalf("Failed: id:004 name:%s bursts:%d", groups[1].name, len(groups[1].bursts))
+	}
+
+	// Events starting in the same minute have unique names
+	groups = groupPictures([]*Picture{pic("a.jpg", 0), pic("b.jpg", 30*time.Second)}, &GroupGaps{burst: time.Second, event: 10 * time.Second})
+	if len(groups) != 2 || groups[1].name != "2022_01_02_10_11_2" {
+		t.Fatalf("Failed: id:005 groups:%d", len(groups))
+	}
+}
+
+func TestGroupGaps(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/groups?burstgap=5s&eventgap=30m", nil)
+	g, err := NewGroupGaps().WithQuery(r)
+	if err != nil || g.burst != 5*time.Second || g.event != 30*time.Minute {
+		t.Fatalf("Failed: id:001 %v %v", g, err)
+	}
+	r, _ = http.NewRequest("GET", "/groups?burstgap=5h", nil)
+	_, err = NewGroupGaps().WithQuery(r)
+	if err == nil {
+		t.Fatalf("Failed: id:002 burstgap more than eventgap should fail")
+	}
+	_, err = validGap(BURST_GAP_ARG, "5")
+	if err == nil {
+		t.Fatalf("Failed: id:003 a duration without a unit should fail")
+	}
+	_, err = validLayout("flat")
+	if err == nil {
+		t.Fatalf("Failed: id:004 layout=flat should fail")
+	}
+}
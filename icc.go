@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	ICC_ARG = "icc="
+
+	ICC_JPEG_MARKER = "ICC_PROFILE\x00"
+	ICC_HEADER_LEN  = 128
+	ICC_MAX_BYTES   = 4 * 1024 * 1024 // Profiles larger than this are rejected
+)
+
+var (
+	// The ICC profile connection space white point
+	ICC_D50_WHITE = [3]float64{0.9642, 1.0, 0.8249}
+
+	// XYZ (D50) to linear sRGB. The inverse of the Bradford adapted sRGB matrix used by ICC profiles.
+	XYZ_D50_TO_SRGB = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+)
+
+//
+// A tone reproduction curve. Maps an encoded value 0..1 to a linear value 0..1.
+//
+type iccCurve func(float64) float64
+
+//
+// An RGB matrix/TRC ICC profile.
+// matrix converts linear RGB to XYZ (D50). The columns are the rXYZ, gXYZ and bXYZ tags.
+//
+type ICCProfile struct {
+	description string
+	matrix      [3][3]float64
+	trc         [3]iccCurve
+}
+
+//
+// Converts pixels from a profile to sRGB using look up tables.
+//
+type ICCTransform struct {
+	linear [3][256]float64
+	matrix [3][3]float64
+	encode [4096]uint8
+}
+
+//
+// Read the ICC profile embedded in a jpg (APP2) or png (iCCP) file. nil if there is no profile.
+//
+func readICCData(source string) ([]byte, error) {
+	f, err := openImage(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	sig, err := r.Peek(8)
+	if err != nil {
+		return nil, nil
+	}
+	if sig[0] == 0xFF && sig[1] == 0xD8 {
+		return readJpegICC(r)
+	}
+	if string(sig) == "\x89PNG\r\n\x1a\n" {
+		return readPngICC(r)
+	}
+	return nil, nil
+}
+
+//
+// The profile can be split over more than one APP2 segment. Each has a sequence number and a count.
+// The total size of the segments is limited to ICC_MAX_BYTES.
+//
+func readJpegICC(r *bufio.Reader) ([]byte, error) {
+	r.Discard(2)
+	chunks := make(map[int][]byte)
+	count := 0
+	size := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil
+		}
+		if b != 0xFF {
+			continue
+		}
+		marker, err := r.ReadByte()
+		if err != nil {
+			return nil, nil
+		}
+		if marker == 0xFF || marker == 0x00 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			if marker == 0xFF {
+				r.UnreadByte()
+			}
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan. The profile must be before the image data
+			break
+		}
+		var length uint16
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err != nil || length < 2 {
+			return nil, nil
+		}
+		seg := make([]byte, length-2)
+		_, err = io.ReadFull(r, seg)
+		if err != nil {
+			return nil, nil
+		}
+		if marker == 0xE2 && len(seg) > len(ICC_JPEG_MARKER)+2 && string(seg[:len(ICC_JPEG_MARKER)]) == ICC_JPEG_MARKER {
+			seq := int(seg[len(ICC_JPEG_MARKER)])
+			count = int(seg[len(ICC_JPEG_MARKER)+1])
+			chunks[seq] = seg[len(ICC_JPEG_MARKER)+2:]
+			size += len(chunks[seq])
+			if size > ICC_MAX_BYTES {
+				return nil, fmt.Errorf("icc profile exceeds the limit of %d bytes", ICC_MAX_BYTES)
+			}
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	var data []byte
+	for i := 1; i <= count; i++ {
+		c, ok := chunks[i]
+		if !ok {
+			return nil, fmt.Errorf("icc profile segment %d of %d is missing", i, count)
+		}
+		data = append(data, c...)
+	}
+	return data, nil
+}
+
+func readPngICC(r *bufio.Reader) ([]byte, error) {
+	r.Discard(8)
+	for {
+		var length uint32
+		err := binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return nil, nil
+		}
+		typ := make([]byte, 4)
+		_, err = io.ReadFull(r, typ)
+		if err != nil {
+			return nil, nil
+		}
+		switch string(typ) {
+		case "iCCP":
+			if length > ICC_MAX_BYTES {
+				return nil, fmt.Errorf("png iCCP chunk size %d exceeds the limit of %d bytes", length, ICC_MAX_BYTES)
+			}
+			data := make([]byte, length)
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				return nil, nil
+			}
+			// Profile name, null, compression method (0 = zlib), compressed profile
+			i := bytes.IndexByte(data, 0)
+			if i < 0 || i+2 > len(data) {
+				return nil, fmt.Errorf("png iCCP chunk is invalid")
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			// A small chunk can inflate to a huge profile
+			profile, err := io.ReadAll(io.LimitReader(zr, ICC_MAX_BYTES+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(profile) > ICC_MAX_BYTES {
+				return nil, fmt.Errorf("icc profile exceeds the limit of %d bytes", ICC_MAX_BYTES)
+			}
+			return profile, nil
+		case "IDAT", "IEND":
+			// The profile must be before the image data
+			return nil, nil
+		}
+		_, err = r.Discard(int(length) + 4)
+		if err != nil {
+			return nil, nil
+		}
+	}
+}
+
+//
+// Parse an ICC profile. Only RGB matrix/TRC and grey (kTRC) profiles are supported.
+// An error is returned for other profiles (for example CMYK or LUT based profiles).
+//
+func parseICC(data []byte) (*ICCProfile, error) {
+	if len(data) < ICC_HEADER_LEN+4 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("icc profile is invalid")
+	}
+	colourSpace := string(data[16:20])
+	pcs := string(data[20:24])
+	if colourSpace != "RGB " && colourSpace != "GRAY" {
+		return nil, fmt.Errorf("icc profile colour space '%s' is not supported", strings.TrimSpace(colourSpace))
+	}
+	if pcs != "XYZ " {
+		return nil, fmt.Errorf("icc profile connection space '%s' is not supported", strings.TrimSpace(pcs))
+	}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[ICC_HEADER_LEN:]))
+	for i := 0; i < count; i++ {
+		p := ICC_HEADER_LEN + 4 + i*12
+		if p+12 > len(data) {
+			return nil, fmt.Errorf("icc profile tag table is invalid")
+		}
+		offset := int(binary.BigEndian.Uint32(data[p+4:]))
+		size := int(binary.BigEndian.Uint32(data[p+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, fmt.Errorf("icc profile tag '%s' is invalid", string(data[p:p+4]))
+		}
+		tags[string(data[p:p+4])] = data[offset : offset+size]
+	}
+
+	prof := &ICCProfile{description: iccDescription(tags["desc"])}
+	if colourSpace == "GRAY" {
+		// A grey value maps to the D50 white point scaled by the TRC. R = G = B after conversion
+		trc, err := iccTRC(tags["kTRC"])
+		if err != nil {
+			return nil, fmt.Errorf("icc profile '%s' is not a grey TRC profile. kTRC: %s", prof.description, err.Error())
+		}
+		for r, w := range ICC_D50_WHITE {
+			prof.matrix[r] = [3]float64{w / 3, w / 3, w / 3}
+		}
+		prof.trc = [3]iccCurve{trc, trc, trc}
+		return prof, nil
+	}
+	for c, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, err := iccXYZ(tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("icc profile '%s' is not a matrix/TRC profile. %s: %s", prof.description, name, err.Error())
+		}
+		for r := 0; r < 3; r++ {
+			prof.matrix[r][c] = xyz[r]
+		}
+	}
+	for c, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		trc, err := iccTRC(tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("icc profile '%s' is not a matrix/TRC profile. %s: %s", prof.description, name, err.Error())
+		}
+		prof.trc[c] = trc
+	}
+	return prof, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func iccXYZ(tag []byte) ([3]float64, error) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, fmt.Errorf("XYZ tag is missing or invalid")
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, nil
+}
+
+func iccTRC(tag []byte) (iccCurve, error) {
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("TRC tag is missing or invalid")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+n*2 {
+			return nil, fmt.Errorf("curv tag is invalid")
+		}
+		if n == 0 {
+			return func(x float64) float64 { return x }, nil
+		}
+		if n == 1 {
+			g := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+		}
+		return func(x float64) float64 {
+			p := math.Min(math.Max(x, 0), 1) * float64(n-1)
+			i := int(p)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(p-float64(i))
+		}, nil
+	case "para":
+		fn := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if fn > 4 || len(tag) < 12+counts[fn]*4 {
+			return nil, fmt.Errorf("para tag function %d is invalid", fn)
+		}
+		var p [7]float64
+		for i := 0; i < counts[fn]; i++ {
+			p[i] = s15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch fn {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}, nil
+		default:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("TRC type '%s' is not supported", string(tag[:4]))
+}
+
+//
+// The profile description from a 'desc' (v2) or 'mluc' (v4) tag.
+//
+func iccDescription(tag []byte) string {
+	if len(tag) < 12 {
+		return "unknown"
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > 0 && len(tag) >= 12+n {
+			return strings.TrimRight(string(tag[12:12+n]), "\x00")
+		}
+	case "mluc":
+		if len(tag) >= 28 {
+			size := int(binary.BigEndian.Uint32(tag[20:]))
+			offset := int(binary.BigEndian.Uint32(tag[24:]))
+			if offset+size <= len(tag) {
+				u := make([]uint16, size/2)
+				for i := range u {
+					u[i] = binary.BigEndian.Uint16(tag[offset+i*2:])
+				}
+				return string(utf16.Decode(u))
+			}
+		}
+	}
+	return "unknown"
+}
+
+//
+// The transform from the profile to sRGB. nil if the profile is already (close to) sRGB.
+//
+func (p *ICCProfile) toSRGB() *ICCTransform {
+	t := &ICCTransform{}
+	identity := true
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			for k := 0; k < 3; k++ {
+				t.matrix[r][c] += XYZ_D50_TO_SRGB[r][k] * p.matrix[k][c]
+			}
+			expected := 0.0
+			if r == c {
+				expected = 1
+			}
+			if math.Abs(t.matrix[r][c]-expected) > 0.01 {
+				identity = false
+			}
+		}
+	}
+	for c := 0; c < 3; c++ {
+		for v := 0; v < 256; v++ {
+			x := float64(v) / 255
+			t.linear[c][v] = p.trc[c](x)
+			if math.Abs(t.linear[c][v]-srgbToLinear(x)) > 0.01 {
+				identity = false
+			}
+		}
+	}
+	if identity {
+		return nil
+	}
+	for i := range t.encode {
+		t.encode[i] = clampByte(float32(linearToSrgb(float64(i)/float64(len(t.encode)-1)) * 255))
+	}
+	return t
+}
+
+//
+// Convert the opaque pixels in the image to sRGB. The image is updated and returned.
+//
+func (t *ICCTransform) apply(img *image.RGBA) *image.RGBA {
+	if t == nil {
+		return img
+	}
+	max := float64(len(t.encode) - 1)
+	forEachPixel(img, func(p []uint8) {
+		if p[3] != 255 {
+			return
+		}
+		r, g, b := t.linear[0][p[0]], t.linear[1][p[1]], t.linear[2][p[2]]
+		for c := 0; c < 3; c++ {
+			v := t.matrix[c][0]*r + t.matrix[c][1]*g + t.matrix[c][2]*b
+			p[c] = t.encode[int(math.Min(math.Max(v, 0), 1)*max+0.5)]
+		}
+	})
+	return img
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+//
+// Convert the image to sRGB using the profile in the source file. The profile details are added to info.
+// If the profile is not supported a warning is logged and the image is not changed.
+//
+func iccToSRGB(source string, img *image.RGBA, info *ThumbInfo) *image.RGBA {
+	t, desc, err := iccTransformFor(source)
+	if err != nil {
+		logServer("WARNING:ICC", source, err)
+		info.iccWarning = err.Error()
+		return img
+	}
+	info.icc = desc
+	info.iccConverted = t != nil
+	return t.apply(img)
+}
+
+//
+// Read the ICC profile from the image file and return the transform to sRGB.
+// nil transform if there is no profile or it is already sRGB.
+// description is the profile description. An error is returned if the profile is not supported.
+//
+func iccTransformFor(source string) (*ICCTransform, string, error) {
+	data, err := readICCData(source)
+	if err != nil || data == nil {
+		return nil, "", err
+	}
+	prof, err := parseICC(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return prof.toSRGB(), prof.description, nil
+}
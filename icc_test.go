@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sRGB primaries adapted to D50 (columns are rXYZ, gXYZ, bXYZ)
+var srgbD50 = [3][3]float64{{0.4361, 0.3851, 0.1431}, {0.2225, 0.7169, 0.0606}, {0.0139, 0.0971, 0.7141}}
+
+// Display P3 primaries adapted to D50
+var p3D50 = [3][3]float64{{0.5151, 0.2920, 0.1571}, {0.2412, 0.6922, 0.0666}, {-0.0011, 0.0419, 0.7841}}
+
+//
+// Build a minimal RGB matrix/TRC or grey profile. The TRC is an sRGB para curve (type 3).
+//
+func testICCProfile(colourSpace, desc string, m [3][3]float64) []byte {
+	fixed := func(v float64) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(int32(math.Round(v*65536))))
+		return b
+	}
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{}
+	d := append([]byte("desc\x00\x00\x00\x00"), 0, 0, 0, byte(len(desc)+1))
+	tags = append(tags, tag{"desc", append(append(d, desc...), 0)})
+	para := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		para = append(para, fixed(v)...)
+	}
+	if colourSpace == "GRAY" {
+		// Grey profiles have a single curve
+		tags = append(tags, tag{"kTRC", para})
+	} else {
+		for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+			x := []byte("XYZ \x00\x00\x00\x00")
+			x = append(append(append(x, fixed(m[0][c])...), fixed(m[1][c])...), fixed(m[2][c])...)
+			tags = append(tags, tag{sig, x})
+		}
+		for _, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+			tags = append(tags, tag{sig, para})
+		}
+	}
+	header := make([]byte, ICC_HEADER_LEN)
+	copy(header[16:], colourSpace)
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	table := make([]byte, 4+len(tags)*12)
+	binary.BigEndian.PutUint32(table, uint32(len(tags)))
+	offset := len(header) + len(table)
+	body := []byte{}
+	for i, t := range tags {
+		copy(table[4+i*12:], t.sig)
+		binary.BigEndian.PutUint32(table[8+i*12:], uint32(offset+len(body)))
+		binary.BigEndian.PutUint32(table[12+i*12:], uint32(len(t.data)))
+		body = append(body, t.data...)
+	}
+	return append(append(header, table...), body...)
+}
+
+//
+// Write a jpeg with the profile in two APP2 segments (in reverse order).
+//
+func writeTestICCJpeg(t *testing.T, fileName string, profile []byte, c color.RGBA) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, 255
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(profile) / 2
+	app2 := func(seq int, data []byte) []byte {
+		seg := append([]byte(ICC_JPEG_MARKER), byte(seq), 2)
+		seg = append(seg, data...)
+		return append([]byte{0xFF, 0xE2, byte((len(seg) + 2) >> 8), byte(len(seg) + 2)}, seg...)
+	}
+	out := append([]byte{}, buf.Bytes()[:2]...)
+	out = append(out, app2(2, profile[half:])...)
+	out = append(out, app2(1, profile[:half])...)
+	out = append(out, buf.Bytes()[2:]...)
+	err = os.WriteFile(fileName, out, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestICCProfile(t *testing.T) {
+	prof, err := parseICC(testICCProfile("RGB ", "sRGB IEC61966-2.1", srgbD50))
+	if err != nil {
+		t.Fatalf("Failed: id:001 %s", err.Error())
+	}
+	if prof.description != "sRGB IEC61966-2.1" {
+		t.Fatalf("Failed: id:002 description:%s", prof.description)
+	}
+	if prof.toSRGB() != nil {
+		t.Fatalf("Failed: id:003 sRGB profile should not need a transform")
+	}
+
+	prof, err = parseICC(testICCProfile("RGB ", "Display P3", p3D50))
+	if err != nil {
+		t.Fatalf("Failed: id:004 %s", err.Error())
+	}
+	tr := prof.toSRGB()
+	if tr == nil {
+		t.Fatalf("Failed: id:005 P3 profile should need a transform")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	copy(img.Pix, []uint8{128, 128, 128, 255, 0, 255, 0, 255})
+	tr.apply(img)
+	// Grey stays grey. P3 green is outside sRGB so red and blue are clipped to 0
+	g := img.RGBAAt(0, 0)
+	if absInt(int(g.R)-128) > 2 || absInt(int(g.G)-128) > 2 || absInt(int(g.B)-128) > 2 {
+		t.Fatalf("Failed: id:006 grey:%v", g)
+	}
+	g = img.RGBAAt(1, 0)
+	if g.R != 0 || g.G != 255 || g.B != 0 {
+		t.Fatalf("Failed: id:007 green:%v", g)
+	}
+
+	// A grey profile with the sRGB curve does not change grey values
+	prof, err = parseICC(testICCProfile("GRAY", "Grey sRGB", srgbD50))
+	if err != nil {
+		t.Fatalf("Failed: id:008 %s", err.Error())
+	}
+	tr = prof.toSRGB()
+	if tr != nil {
+		img = image.NewRGBA(image.Rect(0, 0, 1, 1))
+		copy(img.Pix, []uint8{90, 90, 90, 255})
+		g = tr.apply(img).RGBAAt(0, 0)
+		if absInt(int(g.R)-90) > 2 || g.R != g.G || g.G != g.B {
+			t.Fatalf("Failed: id:009 grey:%v", g)
+		}
+	}
+
+	_, err = parseICC(testICCProfile("CMYK", "Coated", srgbD50))
+	if err == nil || err.Error() != "icc profile colour space 'CMYK' is not supported" {
+		t.Fatalf("Failed: id:010 CMYK profile should return an error. %v", err)
+	}
+}
+
+func TestICCJpeg(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "p3.jpg")
+	profile := testICCProfile("RGB ", "Display P3", p3D50)
+	writeTestICCJpeg(t, fileName, profile, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	data, err := readICCData(fileName)
+	if err != nil || !bytes.Equal(data, profile) {
+		t.Fatalf("Failed: id:001 profile was not read from the APP2 segments. %v", err)
+	}
+	tr, desc, err := iccTransformFor(fileName)
+	if err != nil || tr == nil || desc != "Display P3" {
+		t.Fatalf("Failed: id:002 desc:%s err:%v", desc, err)
+	}
+	pic := NewPicture(fileName, false)
+	_, info, err := createThumbImage(pic, "t.jpg", NewThumbOptions(8), false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.icc != "Display P3" || !info.iccConverted {
+		t.Fatalf("Failed: id:003 info icc:%s converted:%t", info.icc, info.iccConverted)
+	}
+}
+
+func TestICCLimits(t *testing.T) {
+	iccp := func(profile []byte) []byte {
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(profile)
+		zw.Close()
+		data := append([]byte("name\x00\x00"), z.Bytes()...)
+		chunk := append([]byte("iCCP"), data...)
+		chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk))
+		chunk = append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), chunk...)
+		return append([]byte("\x89PNG\r\n\x1a\n"), chunk...)
+	}
+	profile := testICCProfile("RGB ", "Display P3", p3D50)
+	data, err := readPngICC(bufio.NewReader(bytes.NewReader(iccp(profile))))
+	if err != nil || !bytes.Equal(data, profile) {
+		t.Fatalf("Failed: id:001 profile was not read from the iCCP chunk. %v", err)
+	}
+	// A small chunk that inflates to more than the limit
+	_, err = readPngICC(bufio.NewReader(bytes.NewReader(iccp(make([]byte, ICC_MAX_BYTES+1)))))
+	if err == nil {
+		t.Fatalf("Failed: id:002 a profile larger than the limit should fail")
+	}
+
+	// APP2 segments with a total larger than the limit
+	jpg := []byte{0xFF, 0xD8}
+	seg := append([]byte(ICC_JPEG_MARKER), 0, 255)
+	seg = append(seg, make([]byte, 65000)...)
+	for i := 1; i <= ICC_MAX_BYTES/65000+1; i++ {
+		seg[len(ICC_JPEG_MARKER)] = byte(i)
+		jpg = append(jpg, 0xFF, 0xE2, byte((len(seg)+2)>>8), byte(len(seg)+2))
+		jpg = append(jpg, seg...)
+	}
+	jpg = append(jpg, 0xFF, 0xD9)
+	_, err = readJpegICC(bufio.NewReader(bytes.NewReader(jpg)))
+	if err == nil {
+		t.Fatalf("Failed: id:003 app2 segments larger than the limit should fail")
+	}
+}
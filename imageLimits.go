@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	MAX_PIXELS_ARG   = "maxpixels="
+	MAX_BYTES_ARG    = "maxbytes="
+	PIXEL_BUDGET_ARG = "pixelbudget="
+
+	MEGA = 1000000
+)
+
+//
+// Limits applied before an image is decoded.
+// A small file can decode to a huge image (decompression bomb) so the size in the image header is checked first.
+//
+//    maxPixels The maximum width * height of an image.
+//    maxBytes  The maximum file size.
+//    budget    Limits the total pixels of all the images being decoded at the same time.
+//
+type ImageLimits struct {
+	maxPixels int64
+	maxBytes  int64
+	budget    *PixelBudget
+}
+
+//
+// The image cannot be decoded because it breaks a limit or the header cannot be read.
+// status is the http status the server should return.
+//
+type ImageLimitError struct {
+	status int
+	reason string
+}
+
+//
+// Bounds the number of pixels being decoded at the same time.
+// A decode waits until there is room in the budget.
+//
+type PixelBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	total int64
+	used  int64
+}
+
+func (e *ImageLimitError) Error() string {
+	return e.reason
+}
+
+func NewImageLimits(maxPixels, maxBytes, budget int64) *ImageLimits {
+	return &ImageLimits{maxPixels: maxPixels, maxBytes: maxBytes, budget: NewPixelBudget(budget)}
+}
+
+//
+// Read the limits from the command line args. Pixels are in mega pixels, bytes in mega bytes.
+//
+func NewImageLimitsFromArgs() (*ImageLimits, error) {
+	maxPixels, err := findIntArg(MAX_PIXELS_ARG, 1, 10000, 100)
+	if err != nil {
+		return nil, err
+	}
+	maxBytes, err := findIntArg(MAX_BYTES_ARG, 1, 10000, 100)
+	if err != nil {
+		return nil, err
+	}
+	budget, err := findIntArg(PIXEL_BUDGET_ARG, 1, 100000, 400)
+	if err != nil {
+		return nil, err
+	}
+	return NewImageLimits(int64(maxPixels)*MEGA, int64(maxBytes)*MEGA, int64(budget)*MEGA), nil
+}
+
+func NewPixelBudget(total int64) *PixelBudget {
+	b := &PixelBudget{total: total}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+//
+// Check the file size and the image size in the header.
+// The image config is returned so the caller knows how many pixels the decode needs.
+//
+func (l *ImageLimits) check(source string) (image.Config, error) {
+	stat, err := os.Stat(source)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if l.maxBytes > 0 && stat.Size() > l.maxBytes {
+		return image.Config{}, &ImageLimitError{status: http.StatusRequestEntityTooLarge, reason: fmt.Sprintf("file size %d bytes exceeds the limit of %d bytes", stat.Size(), l.maxBytes)}
+	}
+	f, err := openImage(source)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Config{}, &ImageLimitError{status: http.StatusUnprocessableEntity, reason: fmt.Sprintf("image header cannot be read: %s", err.Error())}
+	}
+	if cfg.Width < 1 || cfg.Height < 1 {
+		return image.Config{}, &ImageLimitError{status: http.StatusUnprocessableEntity, reason: fmt.Sprintf("image size %dx%d is invalid", cfg.Width, cfg.Height)}
+	}
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if l.maxPixels > 0 && pixels > l.maxPixels {
+		return image.Config{}, &ImageLimitError{status: http.StatusRequestEntityTooLarge, reason: fmt.Sprintf("image size %dx%d (%d pixels) exceeds the limit of %d pixels", cfg.Width, cfg.Height, pixels, l.maxPixels)}
+	}
+	return cfg, nil
+}
+
+//
+// Check the limits then decode the image within the pixel budget.
+// copies is the number of full size images the caller holds at the same time, the decoded image and any copies of it.
+// The pixels held in the budget are returned. The caller must release them when the full size images are no longer needed.
+//
+func (l *ImageLimits) decode(source string, copies int64) (image.Image, int64, error) {
+	return l.decodeWithin(source, func(cfg image.Config) int64 {
+		return int64(cfg.Width) * int64(cfg.Height) * copies
+	})
+}
+
+//
+// As decode but reserve returns the pixels to hold for the image size.
+// Everything the caller needs is reserved at once so it never waits for more budget while it holds some.
+//
+func (l *ImageLimits) decodeWithin(source string, reserve func(image.Config) int64) (image.Image, int64, error) {
+	cfg, err := l.check(source)
+	if err != nil {
+		return nil, 0, err
+	}
+	pixels := l.budget.acquire(reserve(cfg))
+	f, err := openImage(source)
+	if err != nil {
+		l.budget.release(pixels)
+		return nil, 0, err
+	}
+	defer f.Close()
+	img, err := decodeImage(f)
+	if err != nil {
+		l.budget.release(pixels)
+		return nil, 0, err
+	}
+	return img, pixels, nil
+}
+
+//
+// Wait until the pixels fit in the budget.
+// An image larger than the whole budget waits until nothing else is being decoded.
+// The pixels held are returned. This is the whole budget if pixels is larger.
+//
+func (b *PixelBudget) acquire(pixels int64) int64 {
+	if pixels > b.total {
+		pixels = b.total
+	}
+	b.mu.Lock()
+	for b.used+pixels > b.total {
+		b.cond.Wait()
+	}
+	b.used += pixels
+	b.mu.Unlock()
+	return pixels
+}
+
+func (b *PixelBudget) release(pixels int64) {
+	if pixels > b.total {
+		pixels = b.total
+	}
+	b.mu.Lock()
+	b.used -= pixels
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
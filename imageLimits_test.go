@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImageLimits(t *testing.T) {
+	dir := t.TempDir()
+	pngFile := filepath.Join(dir, "test.png")
+	f, err := os.Create(pngFile)
+	if err != nil {
+		t.Fatalf("Failed: id:001 error:%s", err.Error())
+	}
+	png.Encode(f, testImage(20, 10))
+	f.Close()
+	badFile := filepath.Join(dir, "bad.png")
+	os.WriteFile(badFile, []byte("not an image"), 0644)
+
+	l := NewImageLimits(200, 10000, 1000)
+	img, reserved, err := l.decode(pngFile, 2)
+	if err != nil || img.Bounds().Dx() != 20 {
+		t.Fatalf("Failed: id:002 decode should pass. error:%v", err)
+	}
+	// The budget is held until the caller releases it
+	if reserved != 400 || l.budget.used != 400 {
+		t.Fatalf("Failed: id:006 reserved:%d used:%d", reserved, l.budget.used)
+	}
+	l.budget.release(reserved)
+	_, _, err = l.decode(badFile, 2)
+	if err == nil || l.budget.used != 0 {
+		t.Fatalf("Failed: id:007 a failed decode should release the budget. used:%d", l.budget.used)
+	}
+	opts := NewThumbOptions(10)
+	opts.limits = NewImageLimits(200, 10000, 1000)
+	_, _, err = createThumbImage(NewPicture(pngFile, true), "", opts, false, false, 0)
+	if err != nil || opts.limits.budget.used != 0 {
+		t.Fatalf("Failed: id:008 the thumbnail should release the budget. used:%d error:%v", opts.limits.budget.used, err)
+	}
+	assertLimitStatus(t, "003", NewImageLimits(199, 10000, 1000), pngFile, http.StatusRequestEntityTooLarge)
+	assertLimitStatus(t, "004", NewImageLimits(200, 10, 1000), pngFile, http.StatusRequestEntityTooLarge)
+	assertLimitStatus(t, "005", NewImageLimits(200, 10000, 1000), badFile, http.StatusUnprocessableEntity)
+}
+
+func TestResamplePixels(t *testing.T) {
+	// A narrow, tall image. The thumbnail is the image size so the resample buffer is 4 times the image
+	opts := NewThumbOptions(100)
+	tmp, thumb := opts.resamplePixels(100, 4000, 1)
+	if tmp != 4*100*4000 || thumb != 2*100*4000 {
+		t.Fatalf("Failed: id:001 tmp:%d thumb:%d", tmp, thumb)
+	}
+	// Rotated 90. The 4000 source columns are scaled to 100 rows of the thumbnail
+	tmp, thumb = opts.resamplePixels(4000, 100, 6)
+	if tmp != 4*4000*100 || thumb != 2*100*4000 {
+		t.Fatalf("Failed: id:002 tmp:%d thumb:%d", tmp, thumb)
+	}
+	// Scaled down by 10
+	tmp, thumb = opts.resamplePixels(2000, 1000, 1)
+	if tmp != 4*200*1000 || thumb != 2*200*100 {
+		t.Fatalf("Failed: id:003 tmp:%d thumb:%d", tmp, thumb)
+	}
+}
+
+func TestPixelBudget(t *testing.T) {
+	b := NewPixelBudget(100)
+	b.acquire(60)
+	done := make(chan bool)
+	go func() {
+		b.acquire(60)
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Failed: id:001 acquire should wait for the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(60)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Failed: id:002 acquire should complete after release")
+	}
+	b.release(60)
+	if b.acquire(500) != 100 || b.used != 100 {
+		t.Fatalf("Failed: id:003 image larger than the budget should use the whole budget. used:%d", b.used)
+	}
+}
+
+func assertLimitStatus(t *testing.T, id string, l *ImageLimits, source string, status int) {
+	_, _, err := l.decode(source, 1)
+	var limitErr *ImageLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Failed: id:%s expected ImageLimitError actual:%v", id, err)
+	}
+	if limitErr.status != status {
+		t.Fatalf("Failed: id:%s expected status:%d actual:%d", id, status, limitErr.status)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+//
+// Transform the image according to the EXIF Orientation value so it displays upright.
+//
+// 1 Upright
+// 2 Mirrored horizontally
+// 3 Upside down
+// 4 Mirrored vertically
+// 5 Mirrored horizontally then rotated anticlockwise 90 (transpose)
+// 6 Rotate clockwise 90
+// 7 Mirrored horizontally then rotated clockwise 90 (transverse)
+// 8 Rotate anticlockwise 90
+//
+// Pixels are moved, not resampled, so the result is exact.
+// Unknown values are logged and the image is returned unchanged.
+//
+func orientImage(img *image.RGBA, orientation int, source string) *image.RGBA {
+	if orientation == 1 {
+		return img
+	}
+	if orientation < 1 || orientation > 8 {
+		logServer("ORIENTATION", source, fmt.Errorf("unknown orientation value %d", orientation))
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	//
+	// Destination x = ax*x + bx*y + cx. Destination y = ay*x + by*y + cy
+	//
+	var ax, bx, cx, ay, by, cy int
+	switch orientation {
+	case 2:
+		ax, bx, cx, ay, by, cy = -1, 0, w-1, 0, 1, 0
+	case 3:
+		ax, bx, cx, ay, by, cy = -1, 0, w-1, 0, -1, h-1
+	case 4:
+		ax, bx, cx, ay, by, cy = 1, 0, 0, 0, -1, h-1
+	case 5:
+		ax, bx, cx, ay, by, cy = 0, 1, 0, 1, 0, 0
+	case 6:
+		ax, bx, cx, ay, by, cy = 0, -1, h-1, 1, 0, 0
+	case 7:
+		ax, bx, cx, ay, by, cy = 0, -1, h-1, -1, 0, w-1
+	case 8:
+		ax, bx, cx, ay, by, cy = 0, 1, 0, -1, 0, w-1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		srcOff := img.PixOffset(b.Min.X, b.Min.Y+y)
+		for x := 0; x < w; x++ {
+			dstOff := ((ay*x+by*y+cy)*dw + (ax*x + bx*y + cx)) * 4
+			copy(dst.Pix[dstOff:dstOff+4], img.Pix[srcOff+x*4:srcOff+x*4+4])
+		}
+	}
+	return dst
+}
+
+//
+// Return the image as an RGBA with bounds starting at 0,0. Converting if required.
+//
+func toRGBA(img image.Image) *image.RGBA {
+	rgba, ok := img.(*image.RGBA)
+	if ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+//
+// Return the size of a w x h image after the orientation is applied.
+//
+func orientedSize(w, h, orientation int) (int, int) {
+	if orientation >= 5 && orientation <= 8 {
+		return h, w
+	}
+	return w, h
+}
+
+//
+// Map a rectangle in the upright (oriented) image back to the source image bounds b.
+// This is the inverse of orientImage.
+//
+func sourceRect(r image.Rectangle, b image.Rectangle, orientation int) image.Rectangle {
+	w, h := b.Dx(), b.Dy()
+	var sr image.Rectangle
+	switch orientation {
+	case 2:
+		sr = image.Rect(w-r.Min.X, r.Min.Y, w-r.Max.X, r.Max.Y)
+	case 3:
+		sr = image.Rect(w-r.Min.X, h-r.Min.Y, w-r.Max.X, h-r.Max.Y)
+	case 4:
+		sr = image.Rect(r.Min.X, h-r.Min.Y, r.Max.X, h-r.Max.Y)
+	case 5:
+		sr = image.Rect(r.Min.Y, r.Min.X, r.Max.Y, r.Max.X)
+	case 6:
+		sr = image.Rect(r.Min.Y, h-r.Min.X, r.Max.Y, h-r.Max.X)
+	case 7:
+		sr = image.Rect(w-r.Min.Y, h-r.Min.X, w-r.Max.Y, h-r.Max.X)
+	case 8:
+		sr = image.Rect(w-r.Min.Y, r.Min.X, w-r.Max.Y, r.Max.X)
+	default:
+		sr = r
+	}
+	return sr.Add(b.Min)
+}
+
+//
+// Return the part of the image within r. The pixels are shared where the image type allows it.
+//
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	si, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if ok {
+		return si.SubImage(r)
+	}
+	return toRGBA(img).SubImage(r.Sub(img.Bounds().Min))
+}
+
+//
+// Multiply the rectangle coordinates by scale.
+//
+func scaleRect(r image.Rectangle, scale float64) image.Rectangle {
+	return image.Rect(int(math.Round(float64(r.Min.X)*scale)), int(math.Round(float64(r.Min.Y)*scale)), int(math.Round(float64(r.Max.X)*scale)), int(math.Round(float64(r.Max.Y)*scale)))
+}
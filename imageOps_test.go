@@ -0,0 +1,60 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOrientImage(t *testing.T) {
+	//
+	// 0 1 2
+	// 3 4 5
+	//
+	img := testImage(3, 2)
+	assertPix(t, "001", orientImage(img, 1, "test"), 3, 2, []uint8{0, 1, 2, 3, 4, 5})
+	assertPix(t, "002", orientImage(img, 2, "test"), 3, 2, []uint8{2, 1, 0, 5, 4, 3})
+	assertPix(t, "003", orientImage(img, 3, "test"), 3, 2, []uint8{5, 4, 3, 2, 1, 0})
+	assertPix(t, "004", orientImage(img, 4, "test"), 3, 2, []uint8{3, 4, 5, 0, 1, 2})
+	assertPix(t, "005", orientImage(img, 5, "test"), 2, 3, []uint8{0, 3, 1, 4, 2, 5})
+	assertPix(t, "006", orientImage(img, 6, "test"), 2, 3, []uint8{3, 0, 4, 1, 5, 2})
+	assertPix(t, "007", orientImage(img, 7, "test"), 2, 3, []uint8{5, 2, 4, 1, 3, 0})
+	assertPix(t, "008", orientImage(img, 8, "test"), 2, 3, []uint8{2, 5, 1, 4, 0, 3})
+	assertPix(t, "009", orientImage(img, 9, "test"), 3, 2, []uint8{0, 1, 2, 3, 4, 5})
+	assertPix(t, "010", orientImage(img, 0, "test"), 3, 2, []uint8{0, 1, 2, 3, 4, 5})
+}
+
+func TestToRGBA(t *testing.T) {
+	img := testImage(4, 4)
+	sub := img.SubImage(image.Rect(1, 1, 3, 3)).(*image.RGBA)
+	assertPix(t, "001", toRGBA(sub), 2, 2, []uint8{5, 6, 9, 10})
+	assertPix(t, "002", orientImage(sub, 6, "test"), 2, 2, []uint8{9, 5, 10, 6})
+}
+
+//
+// Create an image where the red value of each pixel is its index. 0,1,2 is the top row
+//
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(y*w + x), A: 255})
+		}
+	}
+	return img
+}
+
+func assertPix(t *testing.T, id string, img *image.RGBA, w, h int, expected []uint8) {
+	b := img.Bounds()
+	if b.Dx() != w || b.Dy() != h {
+		t.Fatalf("Failed: id:%s expected size:%dx%d actual:%dx%d", id, w, h, b.Dx(), b.Dy())
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r := img.RGBAAt(b.Min.X+x, b.Min.Y+y).R
+			if r != expected[y*w+x] {
+				t.Fatalf("Failed: id:%s pixel %d,%d expected:%d actual:%d", id, x, y, expected[y*w+x], r)
+			}
+		}
+	}
+}
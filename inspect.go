@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+// Write a json line to stdout for each image in srcPath describing how it would be processed.
+// srcPath can be a single file or a directory. palette is the number of palette colours (0 is no palette).
+//
+func inspect(srcPath string, opts *ThumbOptions, palette int) error {
+	return filepath.Walk(srcPath, func(inPath string, info fs.FileInfo, errIn error) error {
+		if errIn != nil {
+			return errIn
+		}
+		if !info.IsDir() {
+			_, ok := THUMB_FILE_TYPES[strings.ToLower(filepath.Ext(inPath))]
+			if ok || isVideoFile(inPath) {
+				fmt.Fprintln(os.Stdout, inspectPicture(inPath, opts, palette))
+			}
+		}
+		return nil
+	})
+}
+
+func inspectPicture(source string, opts *ThumbOptions, palette int) string {
+	pic := NewPicture(source, true)
+	jf := NewJsonFields()
+	jf.Add("file", pic.source)
+	jf.Add("time", pic.time.Format(TIME_FORMAT_MS))
+	jf.Add("timeSource", pic.timeSource)
+	jf.Add("orientation", fmt.Sprintf("%d", pic.orientation))
+	pic.xmp.addTo(jf)
+	pic.iptc.addTo(jf)
+	if pic.err != nil {
+		jf.Add("error", pic.err.Error())
+	}
+	if pic.video != nil {
+		return NewJsonFields().AddRaw("INSPECT", pic.video.addTo(jf).String()).String()
+	}
+	var info *ThumbInfo
+	var err error
+	if opts.animate && pic.ext == THUMB_ANIM_TYPE {
+		_, info, err = createAnimatedThumb(pic, "", opts, false)
+	}
+	if info == nil && err == nil {
+		_, info, err = createThumbImage(pic, "", opts, false, false, 0)
+	}
+	if err != nil {
+		jf.Add("thumbError", err.Error())
+	} else {
+		jf.Add("thumb", fmt.Sprintf("%dx%d", info.width, info.height))
+		jf.Add("fit", opts.fit)
+		if opts.enhance != (Enhance{}) {
+			jf.Add("enhance", opts.enhance.String())
+		}
+		if info.frames > 0 {
+			jf.Add("frames", fmt.Sprintf("%d", info.frames))
+		}
+		if info.colourModel != "" {
+			jf.Add("colourModel", info.colourModel)
+		}
+		if info.icc != "" {
+			jf.Add("icc", info.icc)
+			jf.AddRaw("iccConverted", fmt.Sprintf("%t", info.iccConverted))
+		}
+		if info.iccWarning != "" {
+			jf.Add("iccWarning", info.iccWarning)
+		}
+		if info.noUpscale {
+			jf.AddRaw("noUpscale", "true")
+		}
+		if canPassthrough(pic, opts) {
+			jf.Add("thumbSource", "original")
+		} else if info.preview {
+			jf.Add("thumbSource", "preview")
+		} else {
+			jf.Add("thumbSource", "image")
+		}
+		if info.CropString() != "" {
+			jf.Add("crop", info.CropString())
+			jf.Add("cropStrategy", opts.crop)
+		}
+		if palette > 0 {
+			pal, err := picturePalette(pic, opts, nil, palette)
+			if err == nil {
+				jf.AddRaw("palette", pal)
+			}
+		}
+	}
+	return NewJsonFields().AddRaw("INSPECT", jf.String()).String()
+}
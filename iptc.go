@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	IPTC_JPEG_MARKER  = "Photoshop 3.0\x00"
+	IPTC_RESOURCE_ID  = 0x0404
+	IPTC_TAG_MARKER   = 0x1C
+	IPTC_RECORD       = 2
+	IPTC_KEYWORDS     = 25
+	IPTC_BYLINE       = 80
+	IPTC_CITY         = 90
+	IPTC_SUB_LOCATION = 92
+	IPTC_PROVINCE     = 95
+	IPTC_COUNTRY      = 101
+	IPTC_CAPTION      = 120
+	IPTC_JOIN         = ", "
+)
+
+var (
+	// The IPTC location datasets in the order they are joined
+	IPTC_LOCATION = []int{IPTC_SUB_LOCATION, IPTC_CITY, IPTC_PROVINCE, IPTC_COUNTRY}
+)
+
+//
+// IPTC IIM meta data from the Photoshop (APP13) segment of a jpg file.
+//
+//    caption  Caption/Abstract (2:120).
+//    keywords Keywords (2:25).
+//    byline   By-line (2:80). More than one is joined with a comma.
+//    location Sub-location, City, Province/State and Country (2:92, 2:90, 2:95, 2:101) joined with a comma.
+//
+type IptcMeta struct {
+	caption  string
+	keywords []string
+	byline   string
+	location string
+}
+
+//
+// Read the IPTC data from a jpg file. nil if there is no IPTC data.
+//
+func readIptc(source string) (*IptcMeta, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	sig, err := r.Peek(2)
+	if err != nil || sig[0] != 0xFF || sig[1] != 0xD8 {
+		return nil, nil
+	}
+	// A large block can be split over more than one APP13 segment
+	data := bytes.Join(readJpegSegments(r, 0xED, IPTC_JPEG_MARKER), nil)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	iim, err := photoshopResource(data, IPTC_RESOURCE_ID)
+	if err != nil || iim == nil {
+		return nil, err
+	}
+	return parseIptc(iim)
+}
+
+//
+// Find a resource in a list of Photoshop image resource blocks.
+// Each is '8BIM', id (2), name (pascal string padded to even), size (4) then the data (padded to even).
+//
+func photoshopResource(data []byte, id uint16) ([]byte, error) {
+	for len(data) >= 12 {
+		if string(data[:4]) != "8BIM" {
+			return nil, fmt.Errorf("photoshop resource block is invalid")
+		}
+		rid := binary.BigEndian.Uint16(data[4:6])
+		nameLen := int(data[6]) + 1
+		if nameLen%2 != 0 {
+			nameLen++
+		}
+		i := 6 + nameLen
+		if i+4 > len(data) {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(data[i : i+4]))
+		i += 4
+		if size > len(data)-i {
+			return nil, fmt.Errorf("photoshop resource %04x size %d is invalid", rid, size)
+		}
+		if rid == id {
+			return data[i : i+size], nil
+		}
+		if size%2 != 0 {
+			size++
+		}
+		if i+size > len(data) {
+			break
+		}
+		data = data[i+size:]
+	}
+	return nil, nil
+}
+
+//
+// Parse IPTC IIM datasets. Each is 0x1C, record, dataset, size (2) then the value.
+// If the top bit of the size is set the remaining bits are the number of bytes in the size.
+// Values that are not UTF-8 are assumed to be Latin-1.
+// Parsing stops at a byte that is not a dataset marker. Some writers pad the data with zeros.
+//
+func parseIptc(data []byte) (*IptcMeta, error) {
+	values := make(map[int][]string)
+	for len(data) >= 5 && data[0] == IPTC_TAG_MARKER {
+		record, dataset := int(data[1]), int(data[2])
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		i := 5
+		if size&0x8000 != 0 {
+			n := size & 0x7FFF
+			if n > 4 || i+n > len(data) {
+				return nil, fmt.Errorf("iptc dataset %d:%d size is invalid", record, dataset)
+			}
+			size = 0
+			for _, b := range data[i : i+n] {
+				size = size<<8 | int(b)
+			}
+			i += n
+		}
+		if size > len(data)-i {
+			return nil, fmt.Errorf("iptc dataset %d:%d size %d is invalid", record, dataset, size)
+		}
+		if record == IPTC_RECORD {
+			values[dataset] = append(values[dataset], iptcString(data[i:i+size]))
+		}
+		data = data[i+size:]
+	}
+	x := &IptcMeta{keywords: make([]string, 0)}
+	if v, ok := values[IPTC_CAPTION]; ok {
+		x.caption = v[0]
+	}
+	for _, k := range values[IPTC_KEYWORDS] {
+		if k != "" {
+			x.keywords = append(x.keywords, k)
+		}
+	}
+	x.byline = strings.Join(values[IPTC_BYLINE], IPTC_JOIN)
+	location := make([]string, 0)
+	for _, l := range IPTC_LOCATION {
+		if v, ok := values[l]; ok && v[0] != "" {
+			location = append(location, v[0])
+		}
+	}
+	x.location = strings.Join(location, IPTC_JOIN)
+	return x, nil
+}
+
+func iptcString(b []byte) string {
+	b = bytes.TrimRight(b, "\x00")
+	if utf8.Valid(b) {
+		return strings.TrimSpace(string(b))
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return strings.TrimSpace(string(r))
+}
+
+//
+// Add the IPTC fields that are set as an "iptc" object. Nothing is added if none are set. x can be nil.
+//
+func (x *IptcMeta) addTo(jf *JsonFields) *JsonFields {
+	if x == nil || (x.caption == "" && len(x.keywords) == 0 && x.byline == "" && x.location == "") {
+		return jf
+	}
+	ij := NewJsonFields()
+	if x.caption != "" {
+		ij.Add("caption", x.caption)
+	}
+	if len(x.keywords) > 0 {
+		list := make([]string, len(x.keywords))
+		for i, k := range x.keywords {
+			list[i] = jsonQuote(k)
+		}
+		ij.AddRaw("keywords", "["+strings.Join(list, ",")+"]")
+	}
+	if x.byline != "" {
+		ij.Add("byline", x.byline)
+	}
+	if x.location != "" {
+		ij.Add("location", x.location)
+	}
+	return jf.AddRaw("iptc", ij.String())
+}
+
+//
+// True if the IPTC or XMP keywords contain keyword. Case is ignored.
+//
+func (p *Picture) hasKeyword(keyword string) bool {
+	var keywords []string
+	if p.iptc != nil {
+		keywords = append(keywords, p.iptc.keywords...)
+	}
+	if p.xmp != nil {
+		keywords = append(keywords, p.xmp.keywords...)
+	}
+	for _, k := range keywords {
+		if strings.EqualFold(k, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// The files in the listing that have the keyword. If keyword is "" the list is returned unchanged.
+//
+func filterByKeyword(pics *ListPictures, list []string, keyword string) []string {
+	if keyword == "" {
+		return list
+	}
+	filtered := make([]string, 0)
+	for _, f := range list {
+		if pics.get(f).hasKeyword(keyword) {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
+func queryKeyword(r *http.Request) string {
+	return strings.TrimSpace(r.URL.Query().Get("keyword"))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testIptcDataset(record, dataset byte, value string) []byte {
+	b := []byte{IPTC_TAG_MARKER, record, dataset}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+//
+// Write a jpg with an APP13 segment. The IPTC resource is after another resource with an odd size and a name.
+//
+func writeTestIptcJpeg(t *testing.T, fileName string, datasets ...[]byte) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testXmpImage(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iim := bytes.Join(datasets, nil)
+	seg := []byte(IPTC_JPEG_MARKER)
+	seg = append(seg, "8BIM"...)
+	seg = append(seg, 0x03, 0xED, 3, 'a', 'b', 'c')
+	seg = binary.BigEndian.AppendUint32(seg, 3)
+	seg = append(seg, 1, 2, 3, 0)
+	seg = append(seg, "8BIM"...)
+	seg = binary.BigEndian.AppendUint16(seg, IPTC_RESOURCE_ID)
+	seg = append(seg, 0, 0)
+	seg = binary.BigEndian.AppendUint32(seg, uint32(len(iim)))
+	seg = append(seg, iim...)
+	out := append([]byte{}, buf.Bytes()[:2]...)
+	out = append(out, 0xFF, 0xED, byte((len(seg)+2)>>8), byte(len(seg)+2))
+	out = append(out, seg...)
+	out = append(out, buf.Bytes()[2:]...)
+	err = os.WriteFile(fileName, out, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIptc(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "scan.jpg")
+	writeTestIptcJpeg(t, fileName,
+		testIptcDataset(1, 90, "\x1b%G"),
+		testIptcDataset(2, 0, "\x00\x04"),
+		testIptcDataset(2, IPTC_CAPTION, "Grandma at the fête"),
+		testIptcDataset(2, IPTC_KEYWORDS, "Family"),
+		testIptcDataset(2, IPTC_KEYWORDS, "wedding"),
+		testIptcDataset(2, IPTC_BYLINE, "A. Smith"),
+		testIptcDataset(2, IPTC_CITY, "Bath"),
+		testIptcDataset(2, IPTC_COUNTRY, "UK"))
+	x, err := readIptc(fileName)
+	if err != nil || x == nil {
+		t.Fatalf("Failed: id:001 %v", err)
+	}
+	if x.caption != "Grandma at the fête" || strings.Join(x.keywords, ",") != "Family,wedding" || x.byline != "A. Smith" || x.location != "Bath, UK" {
+		t.Fatalf("Failed: id:002 %+v", x)
+	}
+	js := pictureMeta(NewPicture(fileName, true), NewThumbOptions(200)).String()
+	if !strings.Contains(js, `"iptc":{"caption":"Grandma at the fête","keywords":["Family","wedding"],"byline":"A. Smith","location":"Bath, UK"}`) {
+		t.Fatalf("Failed: id:003 %s", js)
+	}
+	if !strings.Contains(inspectPicture(fileName, NewThumbOptions(200), 0), `"byline":"A. Smith"`) {
+		t.Fatalf("Failed: id:004 inspect should include the iptc data")
+	}
+
+	// Latin-1
+	x, err = parseIptc(testIptcDataset(2, IPTC_CAPTION, "f\xeate"))
+	if err != nil || x.caption != "fête" {
+		t.Fatalf("Failed: id:005 %v %+v", err, x)
+	}
+	_, err = parseIptc(append(testIptcDataset(2, IPTC_CAPTION, "ok"), 0x1C, 2, 120, 0, 50, 'x'))
+	if err == nil {
+		t.Fatalf("Failed: id:006 a dataset larger than the data should fail")
+	}
+	// Zero padding after the last dataset
+	x, err = parseIptc(append(testIptcDataset(2, IPTC_KEYWORDS, "Family"), 0, 0, 0, 0, 0, 0))
+	if err != nil || strings.Join(x.keywords, ",") != "Family" {
+		t.Fatalf("Failed: id:008 %v %+v", err, x)
+	}
+	x, err = readIptc(filepath.Join(dir, "none.png"))
+	if x != nil {
+		t.Fatalf("Failed: id:007 a missing file should not have iptc data")
+	}
+}
+
+func TestKeywordFilter(t *testing.T) {
+	dir := t.TempDir()
+	writeTestIptcJpeg(t, filepath.Join(dir, "a.jpg"), testIptcDataset(2, IPTC_KEYWORDS, "Wedding"))
+	writeTestXmpJpeg(t, filepath.Join(dir, "b.jpg"), testXmpElements)
+	writeTestIptcJpeg(t, filepath.Join(dir, "c.jpg"), testIptcDataset(2, IPTC_KEYWORDS, "holiday"))
+	list := filesOfInterest(dir, false)
+	pics := NewListPictures(dir)
+	if len(filterByKeyword(pics, list, "")) != 3 {
+		t.Fatalf("Failed: id:001 no keyword should not filter")
+	}
+	if strings.Join(filterByKeyword(pics, list, "wedding"), ",") != "a.jpg" {
+		t.Fatalf("Failed: id:002 %v", filterByKeyword(pics, list, "wedding"))
+	}
+	// b.jpg has the keyword in XMP, c.jpg in IPTC
+	if strings.Join(filterByKeyword(pics, list, "HOLIDAY"), ",") != "b.jpg,c.jpg" {
+		t.Fatalf("Failed: id:003 %v", filterByKeyword(pics, list, "HOLIDAY"))
+	}
+	resp := returnFileList(dir, false, false, "holiday")
+	if string(resp.resp) != "[\n  \"b.jpg\",\n  \"c.jpg\"\n]" {
+		t.Fatalf("Failed: id:004 %s", string(resp.resp))
+	}
+	// Each picture is read once for the listing
+	if len(pics.pics) != 3 || pics.get("a.jpg") != pics.get("a.jpg") {
+		t.Fatalf("Failed: id:005 pictures:%d", len(pics.pics))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+//
+// Build a json object from name value pairs, retaining the order they were added.
+//
+type JsonFields struct {
+	sb    strings.Builder
+	count int
+}
+
+func NewJsonFields() *JsonFields {
+	return &JsonFields{count: 0}
+}
+
+//
+// Add a string value. The value is quoted and escaped.
+//
+func (jf *JsonFields) Add(name, value string) *JsonFields {
+	return jf.AddRaw(name, jsonQuote(value))
+}
+
+//
+// Add a value that is already valid json. For example a number, list or object.
+//
+func (jf *JsonFields) AddRaw(name, raw string) *JsonFields {
+	if jf.count > 0 {
+		jf.sb.WriteRune(',')
+	}
+	jf.sb.WriteString(jsonQuote(name))
+	jf.sb.WriteRune(':')
+	jf.sb.WriteString(raw)
+	jf.count++
+	return jf
+}
+
+func (jf *JsonFields) String() string {
+	return "{" + jf.sb.String() + "}"
+}
+
+func jsonQuote(s string) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "\"\""
+	}
+	return string(b)
+}
@@ -5,6 +5,7 @@ import (
 	"image"
 	"image/jpeg"
 	_ "image/png"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
@@ -15,10 +16,18 @@ import (
 	"strings"
 	"time"
 
-	"github.com/liujiawm/graphics-go/graphics"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
+var (
+	// Time fields in order of preference with their matching sub second field
+	EXIF_TIME_FIELDS = [][2]exif.FieldName{
+		{exif.DateTimeOriginal, exif.SubSecTimeOriginal},
+		{exif.DateTimeDigitized, exif.SubSecTimeDigitized},
+		{exif.DateTime, exif.SubSecTime},
+	}
+)
+
 type Picture struct {
 	source      string
 	name        string
@@ -26,14 +35,20 @@ type Picture struct {
 	orientation int
 	err         error
 	time        time.Time
+	timeSource  string
 	modTime     time.Time
+	exif        *exif.Exif
+	video       *VideoMeta
+	xmp         *XmpMeta
+	iptc        *IptcMeta
 }
 
 const (
-	TIME_FORMAT_1 = "2006:01:02 15:04:05"
-	TIME_FORMAT_2 = "2006-01-02T15:04:05"
-	TIME_FORMAT_3 = "20060102_150405"
-	NAME_MASK     = "%YYYY_%MM_%DD_%h_%m_%s_%n.%x"
+	TIME_FORMAT_1  = "2006:01:02 15:04:05"
+	TIME_FORMAT_2  = "2006-01-02T15:04:05"
+	TIME_FORMAT_3  = "20060102_150405"
+	TIME_FORMAT_MS = "2006-01-02T15:04:05.000"
+	NAME_MASK      = "%YYYY_%MM_%DD_%h_%m_%s_%n.%x"
 
 	NC_ARG            = "noclobber"
 	VB_ARG            = "verbose"
@@ -43,6 +58,8 @@ const (
 	LOG_FILE_ARG      = "logfile="
 	SERVER_PORT_ARG   = "serverport="
 	SERVER_CONFIG_ARG = "serverconfig="
+	CONFIG_ARG        = "config="
+	INSPECT_ARG       = "inspect"
 
 	HELP_HINT = ". Use 'help' option to view usage"
 )
@@ -59,11 +76,15 @@ func main() {
 	if err != nil {
 		log.Fatalf("Source path '%s' is invalid %s%s", os.Args[1], err.Error(), HELP_HINT)
 	}
-	sizeInt, err := findIntArg(SIZE_ARG, 10, 1000, 200)
+	sizeInt, err := findIntArg(SIZE_ARG, THUMB_MIN_SIZE, THUMB_MAX_SIZE, 200)
 	if err != nil {
 		log.Fatalf("Invalid size option. Requires an int from 10..1000. %s%s", err.Error(), HELP_HINT)
 	}
 	serverPort, err := findIntArg(SERVER_PORT_ARG, -1, 9999999, -1)
+	thumbOptions, err := NewThumbOptionsFromArgs(sizeInt, serverPort > -1)
+	if err != nil {
+		log.Fatalf("Invalid thumbnail option. %s%s", err.Error(), HELP_HINT)
+	}
 
 	var logFileWriter *LFWriter
 
@@ -103,7 +124,7 @@ func main() {
 		if configDataFile == "" {
 			log.Fatalf("Config data arg [%s] is not defined.", SERVER_CONFIG_ARG)
 		}
-		tns, configErr := NewTnServer(serverPort, srcPath, configDataFile, sizeInt, verbose)
+		tns, configErr := NewTnServer(serverPort, srcPath, configDataFile, thumbOptions, verbose)
 		if configErr != nil {
 			log.Fatalf("Config data [%s] error '%s'.", configDataFile, configErr.Error())
 		}
@@ -119,6 +140,41 @@ func main() {
 		}
 		return
 	}
+	configDataFile := findStringArg(CONFIG_ARG, "")
+	if configDataFile != "" {
+		configData, absFileName, configErr := readConfigData(configDataFile, verbose)
+		if configErr != nil {
+			log.Fatalf("Config data [%s] error '%s'.", configDataFile, configErr.Error())
+		}
+		if thumbOptions.watermark == nil {
+			thumbOptions.watermark, configErr = watermarkFromConfigData(configData, absFileName)
+			if configErr != nil {
+				log.Fatalf("Config data [%s] error '%s'.", configDataFile, configErr.Error())
+			}
+		}
+	}
+	if findBoolArg(INSPECT_ARG, true) {
+		palette, err := validPalette(PALETTE_ARG, findStringArg(PALETTE_ARG, "5"))
+		if err != nil {
+			log.Fatalf("Invalid palette option. %s%s", err.Error(), HELP_HINT)
+		}
+		err = inspect(srcPath, thumbOptions, palette)
+		if err != nil {
+			log.Fatalf("Inspect path '%s' error '%s'%s", srcPath, err.Error(), HELP_HINT)
+		}
+		return
+	}
+	if findBoolArg(QUALITY_ARG, true) {
+		count, err := findIntArg(COUNT_ARG, 0, 1000000, 0)
+		if err != nil {
+			log.Fatalf("Invalid count option. %s%s", err.Error(), HELP_HINT)
+		}
+		err = quality(srcPath, thumbOptions, count)
+		if err != nil {
+			log.Fatalf("Quality path '%s' error '%s'%s", srcPath, err.Error(), HELP_HINT)
+		}
+		return
+	}
 	srcInfo, err := os.Stat(srcPath)
 	if err != nil {
 		log.Fatalf("Source path:%s%s", err.Error()[5:], HELP_HINT)
@@ -140,72 +196,130 @@ func main() {
 
 	fileNameMask := findStringArg(MASK_ARG, NAME_MASK)
 	noClobber := findBoolArg(NC_ARG, true)
+	var index *ThumbIndex
+	indexFile := findStringArg(INDEX_ARG, "")
+	if indexFile != "" {
+		index = NewThumbIndex(indexFile, srcPath, dstPath)
+	}
+	layout, err := validLayout(findStringArg(LAYOUT_ARG, LAYOUT_TREE))
+	if err != nil {
+		log.Fatalf("Invalid layout option. %s%s", err.Error(), HELP_HINT)
+	}
 
-	filepath.Walk(srcPath, func(inPath string, info fs.FileInfo, errIn error) error {
-		if !info.IsDir() {
-			relPath, _ := filepath.Split(inPath[len(srcPath):])
-			relPath = filepath.Clean(relPath)
-			outPath := filepath.Clean(fmt.Sprintf("%s%s", dstPath, relPath))
+	if layout == LAYOUT_EVENTS {
+		gaps, err := NewGroupGapsFromArgs()
+		if err != nil {
+			log.Fatalf("Invalid group option. %s%s", err.Error(), HELP_HINT)
+		}
+		for _, g := range groupPictures(picturesInDir(srcPath), gaps) {
+			outPath := filepath.Join(dstPath, g.name)
 			_, err = os.Stat(outPath)
 			if err != nil {
 				os.MkdirAll(outPath, os.ModePerm)
 			}
-			thumb(inPath, outPath, fileNameMask, sizeInt, noClobber, verbose)
+			for _, p := range g.pictures {
+				index.add(p.source, thumb(p.source, outPath, fileNameMask, thumbOptions, noClobber, verbose))
+			}
 		}
-		return nil
-	})
+	} else {
+		filepath.Walk(srcPath, func(inPath string, info fs.FileInfo, errIn error) error {
+			if !info.IsDir() {
+				relPath, _ := filepath.Split(inPath[len(srcPath):])
+				relPath = filepath.Clean(relPath)
+				outPath := filepath.Clean(fmt.Sprintf("%s%s", dstPath, relPath))
+				_, err = os.Stat(outPath)
+				if err != nil {
+					os.MkdirAll(outPath, os.ModePerm)
+				}
+				index.add(inPath, thumb(inPath, outPath, fileNameMask, thumbOptions, noClobber, verbose))
+			}
+			return nil
+		})
+	}
+	err = index.write()
+	if err != nil {
+		log.Fatalf("Index file '%s' error '%s'", indexFile, err.Error())
+	}
 }
 
+//
+// The picture details for source. If thumbnail is true the meta data (EXIF, video, XMP and IPTC) is read.
+//
 func NewPicture(source string, thumbnail bool) *Picture {
+	pic := readPicture(source, thumbnail)
+	if thumbnail && !os.IsNotExist(pic.err) {
+		pic.applyXmp()
+		iptc, err := readIptc(source)
+		if err != nil {
+			logServer("IPTC", source, err)
+		}
+		pic.iptc = iptc
+	}
+	return pic
+}
+
+func readPicture(source string, thumbnail bool) *Picture {
 	_, fName := filepath.Split(source)
 	ext := filepath.Ext(strings.ToLower(fName))
 	name := fName[0 : len(fName)-len(ext)]
 
 	stat, err := os.Stat(source)
 	if err != nil {
-		return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: time.Now(), time: time.Now(), err: err}
+		return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: time.Now(), time: time.Now(), timeSource: "NOW", err: err}
 	}
 	modTime := stat.ModTime()
-	picTime, err := timeParseStr(name)
+	picTime, picTimeSource, err := timeParseName(name)
 	if err != nil {
 		picTime = modTime
+		picTimeSource = "MODTIME"
 	}
 
 	f, err := os.Open(source)
 	if err != nil {
-		return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: picTime, err: err}
+		return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: picTime, timeSource: picTimeSource, err: err}
 	}
 	defer f.Close()
+	if thumbnail && isVideoFile(source) {
+		vm, err := readVideoMeta(f, stat.Size())
+		if err != nil {
+			return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: picTime, timeSource: picTimeSource, err: err}
+		}
+		t, ts := picTime, picTimeSource
+		if !vm.created.IsZero() {
+			t, ts = vm.wallClock(), "VIDEO:CreationTime"
+		}
+		return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: t, timeSource: ts, video: vm, err: nil}
+	}
 	if thumbnail {
 		x, err := exif.Decode(f)
 		if err != nil {
-			return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: picTime, err: err}
+			return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: picTime, timeSource: picTimeSource, err: err}
 		}
+		// Some files (for example RAW files from some cameras) have EXIF times but no orientation
+		iv := 1
 		i, err := x.Get(exif.Orientation)
-		if err != nil {
-			return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: picTime, err: err}
-		}
-		iv, err := i.Int(0)
-		if err != nil {
-			return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: picTime, err: err}
+		if err == nil {
+			o, err := i.Int(0)
+			if err == nil {
+				iv = o
+			}
 		}
 
-		t, err := timeParseX(x, exif.DateTimeOriginal)
-		if err != nil {
-			t, err = timeParseX(x, exif.DateTimeDigitized)
-			if err != nil {
-				t, err = timeParseX(x, exif.DateTime)
-				if err != nil {
-					t, err = timeParseStr(name)
-					if err != nil {
-						t = modTime
-					}
+		t, ts := picTime, picTimeSource
+		for _, field := range EXIF_TIME_FIELDS {
+			xt, err := timeParseX(x, field[0])
+			if err == nil {
+				subSec, err := subSecParseX(x, field[1])
+				if err == nil {
+					xt = xt.Add(subSec)
 				}
+				t, ts = xt, "EXIF:"+string(field[0])
+				break
 			}
 		}
-		return &Picture{source: source, name: name, ext: ext, orientation: iv, modTime: modTime, time: t, err: nil}
+		return &Picture{source: source, name: name, ext: ext, orientation: iv, modTime: modTime, time: t, timeSource: ts, exif: x, err: nil}
 	}
-	return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: modTime, err: nil}
+	return &Picture{source: source, name: name, ext: ext, orientation: 1, modTime: modTime, time: modTime, timeSource: "MODTIME", err: nil}
 }
 
 func (p *Picture) GetFileName() string {
@@ -224,6 +338,39 @@ func timeParseX(ex *exif.Exif, field exif.FieldName) (time.Time, error) {
 	return timeParseStr(s)
 }
 
+//
+// SubSecTime fields hold the fraction of a second as digits. "12" is 0.12 seconds.
+//
+func subSecParseX(ex *exif.Exif, field exif.FieldName) (time.Duration, error) {
+	v, err := ex.Get(field)
+	if err != nil {
+		return 0, err
+	}
+	s, err := v.StringVal()
+	if err != nil {
+		return 0, err
+	}
+	return subSecParseStr(s)
+}
+
+func subSecParseStr(strSubSec string) (time.Duration, error) {
+	st := strings.Trim(strSubSec, " \x00")
+	if st == "" {
+		return 0, fmt.Errorf("empty sub second string")
+	}
+	if len(st) > 9 {
+		st = st[:9]
+	}
+	i, err := strconv.Atoi(st)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid sub second string '%s'", strSubSec)
+	}
+	for n := len(st); n < 9; n++ {
+		i = i * 10
+	}
+	return time.Duration(i), nil
+}
+
 func timeParseStr(strTime string) (time.Time, error) {
 	st := strings.TrimSpace(strTime)
 	if st == "" {
@@ -242,113 +389,212 @@ func timeParseStr(strTime string) (time.Time, error) {
 	return t, nil
 }
 
-func createThumbImage(pic *Picture, thumbName string, size int, verbose bool, server bool, srcPrefix int) (*image.RGBA, error) {
-	imagePath, err := os.Open(pic.source)
-	if err != nil {
-		logServer("OPEN", pic.source, err)
-		return nil, err
+func createThumbImage(pic *Picture, thumbName string, opts *ThumbOptions, verbose bool, server bool, srcPrefix int) (*image.RGBA, *ThumbInfo, error) {
+	info := &ThumbInfo{colourModel: sourceColourModel(pic.source)}
+	var srcImage image.Image
+	var previewScale float64
+	// The pixels held in the budget. The source and the resample buffer are released after resample.
+	// The thumbnail (thumbPixels) is released when it is returned.
+	var reserved, thumbPixels int64
+	defer func() {
+		opts.limits.budget.release(reserved)
+	}()
+	if opts.preview {
+		srcImage, previewScale = previewImage(pic, opts)
+		info.preview = srcImage != nil
+		if info.preview {
+			var tmpPixels int64
+			tmpPixels, thumbPixels = opts.resamplePixels(srcImage.Bounds().Dx(), srcImage.Bounds().Dy(), pic.orientation)
+			reserved = opts.limits.budget.acquire(tmpPixels + thumbPixels)
+		}
 	}
-	defer imagePath.Close()
-	srcImage, _, err := image.Decode(imagePath)
-	if err != nil {
-		logServer("DECODE", pic.source, err)
-		return nil, err
+	if srcImage == nil {
+		var err error
+		// resample reads the source a row at a time so no full size copy is made
+		srcImage, reserved, err = opts.limits.decodeWithin(pic.source, func(cfg image.Config) int64 {
+			var tmpPixels int64
+			tmpPixels, thumbPixels = opts.resamplePixels(cfg.Width, cfg.Height, pic.orientation)
+			return int64(cfg.Width)*int64(cfg.Height) + tmpPixels + thumbPixels
+		})
+		if err != nil {
+			logServer("DECODE", pic.source, err)
+			return nil, nil, err
+		}
 	}
+	orientation := pic.orientation
 	b := srcImage.Bounds()
-	var sh int
-	var sw int
-	if b.Dx() > b.Dy() {
-		sh = size
-		sw = int(float64(sh) * (float64(b.Dx()) / float64(b.Dy())))
-	} else {
-		sw = size
-		sh = int(float64(sw) * (float64(b.Dy()) / float64(b.Dx())))
+	uw, uh := orientedSize(b.Dx(), b.Dy(), orientation)
+
+	crop := opts.cropRect(uw, uh)
+	if crop.Dx() != uw || crop.Dy() != uh {
+		if opts.crop != CROP_CENTRE {
+			crop = smartCropRect(srcImage, orientation, crop.Dx(), crop.Dy(), opts.crop)
+		}
+		srcImage = subImage(srcImage, sourceRect(crop, b, orientation))
+		uw, uh = crop.Dx(), crop.Dy()
+		info.crop = crop
+		if info.preview {
+			// Report the crop in image coordinates, not preview coordinates
+			info.crop = scaleRect(crop, previewScale)
+		}
+	}
+	sw, sh := opts.scaleSize(uw, uh)
+	if opts.noUpscale && (sw > uw || sh > uh) {
+		sw, sh = uw, uh
+		info.noUpscale = true
+	}
+
+	if orientation != 1 && uw*uh < sw*sh {
+		// The source is smaller than the thumbnail so it is cheaper to rotate before scaling
+		srcImage = orientImage(toRGBA(srcImage), orientation, pic.source)
+		orientation = 1
 	}
 
 	if verbose {
 		if server {
-			log.Printf("{\"THUMB\":{\"w\":\"%d\",\"h\":\"%d\",\"orientation\":\"%d\",\"source\":\"%s\"}}", sw, sh, pic.orientation, strings.ReplaceAll(pic.source[srcPrefix+1:], "\"", "\\\""))
+			log.Printf("{\"THUMB\":{\"w\":\"%d\",\"h\":\"%d\",\"orientation\":\"%d\",\"fit\":\"%s\",\"source\":\"%s\"}}", sw, sh, pic.orientation, opts.fit, strings.ReplaceAll(pic.source[srcPrefix+1:], "\"", "\\\""))
 		} else {
 			if thumbName == "" {
-				logServer("INFO", fmt.Sprintf("W:%d H:%d Orientation:%d in:%s", sw, sh, pic.orientation, pic.source), nil)
+				logServer("INFO", fmt.Sprintf("W:%d H:%d Orientation:%d Fit:%s in:%s", sw, sh, pic.orientation, opts.fit, pic.source), nil)
 			} else {
-				logServer("INFO", fmt.Sprintf("W:%d H:%d Orientation:%d in:%s: out:%s", sw, sh, pic.orientation, pic.source, thumbName), nil)
+				logServer("INFO", fmt.Sprintf("W:%d H:%d Orientation:%d Fit:%s in:%s: out:%s", sw, sh, pic.orientation, opts.fit, pic.source, thumbName), nil)
 			}
 		}
 	}
 
-	dstImage := image.NewRGBA(image.Rect(0, 0, sw, sh))
-	err = graphics.Thumbnail(dstImage, srcImage)
-	if err != nil {
-		logServer("THUMB", pic.source, err)
-		return nil, err
-	}
-
-	if pic.orientation != 1 {
-		// 1 Upright
-		// 6 rotate clockwise 90
-		// 8 rotate anticlockwise 90
-		// 3 Upside Down
-		switch pic.orientation {
-		case 6:
-			rotImage := image.NewRGBA(image.Rect(0, 0, sh, sw))
-			rotErr := graphics.Rotate(rotImage, dstImage, &graphics.RotateOptions{Angle: 1.5708}) // 90
-			if rotErr != nil {
-				logServer("ROTATE 90", pic.source, rotErr)
-			} else {
-				dstImage = rotImage
-			}
-		case 3:
-			rotImage := image.NewRGBA(image.Rect(0, 0, sw, sh))
-			rotErr := graphics.Rotate(rotImage, dstImage, &graphics.RotateOptions{Angle: 3.14159}) // 180
-			if rotErr != nil {
-				logServer("ROTATE 180", pic.source, rotErr)
-			} else {
-				dstImage = rotImage
-			}
-		case 8:
-			rotImage := image.NewRGBA(image.Rect(0, 0, sh, sw))
-			rotErr := graphics.Rotate(rotImage, dstImage, &graphics.RotateOptions{Angle: 4.71239}) // 270
-			if rotErr != nil {
-				logServer("ROTATE 270", pic.source, rotErr)
-			} else {
-				dstImage = rotImage
-			}
-		}
+	// Scale to the size before it is rotated
+	tw, th := orientedSize(sw, sh, orientation)
+	dstImage := resample(srcImage, tw, th, opts.filter)
+	srcImage = nil
+	if thumbPixels < reserved {
+		// Keep the thumbnail pixels. If more than the whole budget was requested it is all kept
+		opts.limits.budget.release(reserved - thumbPixels)
+		reserved = thumbPixels
+	}
+	dstImage = orientImage(dstImage, orientation, pic.source)
+	dstImage = flattenAlpha(dstImage, opts.background)
+	if opts.icc {
+		dstImage = iccToSRGB(pic.source, dstImage, info)
+	}
+	dstImage = opts.enhance.apply(dstImage)
+	dstImage = unsharpMask(dstImage, opts.sharpen)
+	dstImage = opts.watermark.apply(dstImage)
+	info.width, info.height = sw, sh
+	return dstImage, info, nil
+}
+
+//
+// The short side of the thumbnail is size. The long side maintains the aspect ratio.
+//
+func thumbSize(b image.Rectangle, size int) (int, int) {
+	if b.Dx() > b.Dy() {
+		return int(float64(size) * (float64(b.Dx()) / float64(b.Dy()))), size
 	}
-	return dstImage, nil
+	return size, int(float64(size) * (float64(b.Dy()) / float64(b.Dx())))
 }
 
-func thumb(srcFile, thumbPath, thumbNameMask string, size int, noClobber, verbose bool) {
+//
+// Create the thumbnail for srcFile in thumbPath. Returns the thumbnail file name or "" if it was not created.
+//
+func thumb(srcFile, thumbPath, thumbNameMask string, opts *ThumbOptions, noClobber, verbose bool) string {
 	pic := NewPicture(srcFile, true)
 	if pic.err != nil {
 		logServer("EXIF", srcFile, pic.err)
 	}
+	if isVideoFile(srcFile) {
+		// Videos cannot be decoded so there is no thumbnail. With video=copy they are organised by the mask.
+		if opts.video != VIDEO_COPY || pic.err != nil {
+			return ""
+		}
+		return copyOriginal(pic, thumbPath, thumbNameMask, noClobber)
+	}
+	if canPassthrough(pic, opts) {
+		return copyOriginal(pic, thumbPath, thumbNameMask, noClobber)
+	}
+	if opts.animate && pic.ext == THUMB_ANIM_TYPE {
+		animFileName := fmt.Sprintf("%s%c%s", thumbPath, filepath.Separator, subFileName(pic.time, thumbNameMask, pic.name, "gif"))
+		if noClobber {
+			_, err := os.Stat(animFileName)
+			if err == nil {
+				return animFileName
+			}
+		}
+		data, _, err := createAnimatedThumb(pic, animFileName, opts, verbose)
+		if err != nil {
+			return ""
+		}
+		if data != nil {
+			err = os.WriteFile(animFileName, data, 0644)
+			if err != nil {
+				logServer("CREATE", animFileName, err)
+				return ""
+			}
+			return animFileName
+		}
+	}
 	thumbFileName := fmt.Sprintf("%s%c%s", thumbPath, filepath.Separator, subFileName(pic.time, thumbNameMask, pic.name, "jpg"))
 	if noClobber {
 		_, err := os.Stat(thumbFileName)
 		if err == nil {
-			return
+			return thumbFileName
 		}
 	}
 
-	dstImage, err := createThumbImage(pic, thumbFileName, size, verbose, false, 0)
+	dstImage, info, err := createThumbImage(pic, thumbFileName, opts, verbose, false, 0)
 	if err != nil {
-		return
+		return ""
 	}
 
 	newImage, err := os.Create(thumbFileName)
 	if err != nil {
 		logServer("CREATE", thumbFileName, err)
-		return
+		return ""
 	}
 	defer newImage.Close()
 
-	err = jpeg.Encode(newImage, dstImage, &jpeg.Options{Quality: jpeg.DefaultQuality})
+	err = jpeg.Encode(newImage, outputImage(dstImage, info, opts), &jpeg.Options{Quality: jpeg.DefaultQuality})
 	if err != nil {
 		logServer("ENCODE", thumbFileName, err)
-		return
+		return ""
 	}
+	return thumbFileName
+}
+
+//
+// Copy the original file to thumbPath using the mask. Returns the new file name or "" if it was not copied.
+// The file is streamed as videos can be large.
+//
+func copyOriginal(pic *Picture, thumbPath, thumbNameMask string, noClobber bool) string {
+	origFileName := fmt.Sprintf("%s%c%s", thumbPath, filepath.Separator, subFileName(pic.time, thumbNameMask, pic.name, pic.ext[1:]))
+	if noClobber {
+		_, err := os.Stat(origFileName)
+		if err == nil {
+			return origFileName
+		}
+	}
+	in, err := os.Open(pic.source)
+	if err != nil {
+		logServer("OPEN", pic.source, err)
+		return ""
+	}
+	defer in.Close()
+	out, err := os.Create(origFileName)
+	if err != nil {
+		logServer("CREATE", origFileName, err)
+		return ""
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		logServer("CREATE", origFileName, err)
+		os.Remove(origFileName)
+		return ""
+	}
+	return origFileName
 }
 
 func subFileName(time time.Time, mask, name, ext string) string {
@@ -371,6 +617,9 @@ func subFileName(time time.Time, mask, name, ext string) string {
 	if strings.Contains(mfn, "%s") {
 		mfn = strings.ReplaceAll(mfn, "%s", strPad2(time.Second()))
 	}
+	if strings.Contains(mfn, "%SSS") {
+		mfn = strings.ReplaceAll(mfn, "%SSS", strPad3(time.Nanosecond()/1000000))
+	}
 	if strings.Contains(mfn, "%n") {
 		mfn = strings.ReplaceAll(mfn, "%n", name)
 	}
@@ -387,6 +636,16 @@ func strPad2(i int) string {
 	return strconv.Itoa(i)
 }
 
+func strPad3(i int) string {
+	if i > 99 {
+		return strconv.Itoa(i)
+	}
+	if i > 9 {
+		return "0" + strconv.Itoa(i)
+	}
+	return "00" + strconv.Itoa(i)
+}
+
 func strPad4(i int) string {
 	if i > 999 {
 		return strconv.Itoa(i)
@@ -445,10 +704,14 @@ func exitWithHelp(s string, rc int) {
 	help := []byte(`
 Usage:
 	%{app} <src-dir> <dest-dir> [options]
+	%{app} <src-file-or-dir> inspect [config=<file>] [palette=n]
+	%{app} <src-file-or-dir> quality [count=n]
 Function: 
 	Recursivly walk <src-dir> creating <dest-dir> with the same directory structure.
-	Convert all '.jpg' and '.png' files to thumbnails in the <dest-dir>.
-		All thumbnails are created as '.jpg' files.
+	Convert all '.jpg', '.png' and '.gif' files to thumbnails in the <dest-dir>.
+		All thumbnails are created as '.jpg' files. Animated thumbnails are created as '.gif' files.
+		RAW files ('.cr2', '.nef', '.arw' and '.dng') are converted using the largest embedded jpg preview.
+		Videos ('.mp4', '.m4v', '.mov' and '.3gp') do not have thumbnails (see video=).
 
 	<src-dir>: is the root directory with the original pictures in it.
 	<dest-dir>: is the root of the directory containing the thumbnails.
@@ -459,8 +722,86 @@ Options:
 
 	If height > width then size will be the width. Aspect ratio is maintained.
 	If width > height then size will be the height. Aspect ratio is maintained.
+
+	fit=short|long|contain|cover: How the thumbnail is fitted to the size. Default = short.
+		short:   The short side is size (as above).
+		long:    The long side is size.
+		contain: The thumbnail fits inside a width x height box. Aspect ratio is maintained.
+		cover:   The thumbnail is exactly width x height. The image is cropped to fit.
+
+	crop=centre|edges|entropy|saturation: How the fit=cover crop is chosen. Default = centre.
+		centre:     The centre of the image is used.
+		edges:      The area with the most detail (edges) is used.
+		entropy:    The area with the most varied brightness is used.
+		saturation: The area with the most colour is used.
+
+	width=n height=n: The box used by fit=contain and fit=cover. Default = size.
+
+	filter=nearest|bilinear|catmullrom|lanczos: The resampling filter. Default = catmullrom.
+		nearest is the fastest. lanczos is the sharpest but slowest.
+
+	sharpen=n: Sharpen the thumbnail after scaling (unsharp mask). 0 = off, 0.5 = mild, 2 = max. Default = 0.
+
+	preview=true|false: Use the small JPEG preview embedded in the EXIF data if it is big enough.
+		This is much faster but may be lower quality. Default = false (true when running as a server).
+
+	animate=true|false: Create animated '.gif' thumbnails from animated '.gif' files. Default = false.
+		Each frame is scaled. The frame delays and disposal are kept.
+		If the gif has more than maxframes=n frames (default 100) or the thumbnail is larger than
+		maxanimkb=n kilo bytes (default 2048) a static '.jpg' thumbnail of the first frame is created.
+		A watermark also creates a static '.jpg' thumbnail (with the watermark).
+
+	background=colour: Transparent areas (png, gif) are filled with this colour as jpg has no transparency.
+		white, black, grey or a hex colour RRGGBB. Default = white.
+
+	maxlong=n: The maximum long side of a thumbnail. 0 = no limit. Default = 0.
+	maxaspect=n: The maximum long side of a thumbnail is n x the short side. 0 = no limit. Default = 0.
+		For example with size=200 a 10:1 panorama is 2000 x 200. With maxaspect=3 it is 600 x 60.
+	panorama=scale|crop: What happens when a thumbnail is over maxlong or maxaspect. Default = scale.
+		scale: The thumbnail is scaled down further.
+		crop:  The centre of the long side of the image is used.
+
+	icc=true|false: Convert images with an embedded ICC colour profile (Adobe RGB, Display P3) to sRGB.
+		Only RGB matrix/TRC and grey profiles are supported. A warning is logged for other profiles. Default = true.
+
+	grey=rgb|keep: rgb = Thumbnails of grey images are saved as RGB. keep = They are saved as grey (single channel) jpg files.
+		Default = rgb.
+
+	enhance=off|auto|contrast|whitebalance: Improve flat and dull images (old scans). Default = off.
+		A comma separated list. For example enhance=auto,contrast,whitebalance
+		auto:         Auto levels. The darkest pixels become black and the lightest become white.
+		contrast:     Auto contrast. Increase the contrast of flat images.
+		whitebalance: Remove a colour cast.
+		Only the thumbnail is changed. It is applied after scaling so it is cheap.
+
+	watermark=text: Draw the text on each thumbnail. Letters are drawn in upper case.
+	watermarkimage=file: Draw the image (a png logo) on each thumbnail.
+	wmposition=topleft|topright|bottomleft|bottomright|centre: Where the watermark is drawn. Default = bottomright.
+	wmopacity=n: 0..1. 1 is opaque. Default = 0.5.
+	wmscale=n: 0..1. The watermark height as a fraction of the thumbnail short side. Default = 0.06.
+	wmcolour=colour: The text colour. Default = white.
+		The watermark can also be defined in the config=<file> (see README).
+
+	noupscale=true|false: Images smaller than the thumbnail size are not scaled up. The thumbnail is the image size.
+		Default = false (true when running as a server).
+	small=reencode|passthrough: For noupscale. How an image smaller than the thumbnail is returned.
+		reencode:    A '.jpg' thumbnail the same size as the image. This is the default.
+		passthrough: A copy of the original file. Only if it does not need rotating or cropping.
+
+	video=skip|copy: Videos cannot be decoded so they do not have a thumbnail. Default = skip.
+		skip: Videos are ignored.
+		copy: A copy of the video is written using the mask so videos are organised with the thumbnails.
+		The time is the creation time in the video meta data.
+
+	maxpixels=n: Images larger than n mega pixels (width x height) are not decoded. Default = 100.
+	maxbytes=n: Files larger than n mega bytes are not decoded. Default = 100.
+		The image size is read from the file header before the image is decoded.
+	pixelbudget=n: The total mega pixels that can be decoded at the same time. Default = 400.
+		Additional images wait until there is room. This bounds the memory used by the server.
 	
 	All thumbnails will be rotated according to the EXIF Orientation meta data field if available.
+	An XMP sidecar file orientation is used before the EXIF orientation.
+	All eight orientations are supported, including the mirrored values 2, 4, 5 and 7.
 
 	mask=<filename-mask>: This is the file name mask used to generate the name of the thumbnail.
 	Default value is '%YYYY_%MM_%DD_%h_%m_%s_%n.%x'. This sorts file names in date time order.
@@ -472,15 +813,50 @@ Options:
 	%h	is a 2 digit hour in 24 hour format
 	%m	is a 2 digit minute
 	%s	is a 2 digit second
+	%SSS	is a 3 digit millisecond. From the EXIF SubSecTimeOriginal meta data if available.
+		Use this to order burst photos taken in the same second. For example:
+		'%YYYY_%MM_%DD_%h_%m_%s_%SSS_%n.%x'
 	%n	is the name of the original file without the suffix (.jpg)
 		For an image file ~/Pictures/myPic.jpg, %n is 'myPic'
-	%x	is always 'jpg' which is the format of the thumbnail file.
+	%x	is always 'jpg' which is the format of the thumbnail file. 'gif' for animated thumbnails.
+		For videos copied with video=copy it is the suffix of the video (mp4).
 	
 	The time used is derived from the EXIF DateTimeOriginal meta data in the original image.
-	If that is not available then the file name is parsed (format "20060102_150405.jpg") for a date time.
+	For videos it is the creation time in the video meta data (mvhd).
+	A date in an XMP sidecar file (IMG_0001.xmp or IMG_0001.jpg.xmp) is used before the EXIF date.
+	A date in XMP embedded in the image is used if there is no EXIF date.
+	If that is not available then the file name is parsed for a date time.
+		Common phone and camera names are recognised. For example:
+		IMG_20200102_150405, PXL_20210304_101112345, Screenshot_2021-05-06-07-08-09, IMG-20200102-WA0001
+		Additional rules can be added using the config=<file> option (see README).
 	If that fails then the file system 'modified' date time is used.
 	As a last resort the current date time is used.
 
+	config=<file>: A json config file. The 'resources.timeRules' list adds file name time rules.
+		The 'resources.watermark' object defines a watermark if watermark= and watermarkimage= are not given.
+
+	inspect: Do not create thumbnails. Write a json line to the console for each image in <src-file-or-dir>
+	showing the time derived for it and where that time came from (timeSource).
+		The XMP rating, title and keywords and the IPTC caption, keywords, byline and location are shown if they are set.
+		palette=n: The number of dominant colours shown for each image. 0 to 16. 0 is none. Default = 5.
+
+	metacache=n: The server caches up to n files of meta data that needs the image to be decoded
+		(palette and placeholder). 0 is no cache. Default = 10000.
+
+	quality: Do not create thumbnails. Write a json line to the console for each image in <src-file-or-dir>
+	with a sharpness and exposure score. The blurriest images are first.
+		count=n: Only the n blurriest images. Default = all.
+
+	layout=tree|events: tree = The thumbnails have the same directory structure as <src-dir>. This is the default.
+		events = The thumbnails are grouped by the time they were taken. One directory per event in <dest-dir>.
+		The directory name is the time of the first picture (YYYY_MM_DD_hh_mm).
+	eventgap=<duration>: Pictures taken more than this apart are in different events. Default = 3h.
+	burstgap=<duration>: Pictures taken less than this apart are a burst. Default = 2s.
+		A duration is a number and unit. For example 2s, 90m or 3h.
+
+	index=<file>: Write a json index of the thumbnails to <file>. Each entry has the source and thumbnail
+	file names (relative to <src-dir> and <dest-dir>), the thumbnail width and height and a BlurHash placeholder.
+
 	noclobber: Will not overrwrite existing thumbnail files with the same file name.
 	Default = clobber
 
@@ -491,7 +867,6 @@ Options:
 
 Thanks:
 	https://github.com/rwcarlsen/goexif (rwcarlsen) for the excelelent EXIF library. 
-	https://pkg.go.dev/github.com/liujiawm/graphics-go (liujiawm) for porting the graphics library from the original Google code.
 `)
 	if s != "" {
 		fmt.Printf("Error: %s", s)
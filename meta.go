@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+//
+// The upright (oriented) size of the image from the image header. The image is not decoded.
+//
+func imageSize(pic *Picture) (int, int, error) {
+	f, err := openImage(pic.source)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	w, h := orientedSize(cfg.Width, cfg.Height, pic.orientation)
+	return w, h, nil
+}
+
+//
+// With noupscale and small=passthrough an image smaller than the thumbnail is returned untouched.
+// It must not need rotating, cropping, enhancing or a watermark.
+//
+func canPassthrough(pic *Picture, opts *ThumbOptions) bool {
+	if !opts.noUpscale || opts.small != SMALL_PASSTHROUGH || pic.orientation != 1 || opts.watermark != nil || opts.enhance != (Enhance{}) || isRawFile(pic.source) {
+		return false
+	}
+	w, h, err := imageSize(pic)
+	if err != nil {
+		return false
+	}
+	crop := opts.cropRect(w, h)
+	if crop.Dx() != w || crop.Dy() != h {
+		return false
+	}
+	_, _, small := opts.effectiveSize(w, h)
+	return small
+}
+
+//
+// Meta data for an image file. The image is not decoded.
+// thumbWidth and thumbHeight are the size of the thumbnail that would be returned using opts.
+// Videos have the size and duration from the video meta data (see VideoMeta) but no thumbnail.
+//
+func pictureMeta(pic *Picture, opts *ThumbOptions) *JsonFields {
+	jf := NewJsonFields()
+	jf.Add("name", pic.GetFileName())
+	jf.Add("time", pic.time.Format(TIME_FORMAT_MS))
+	jf.Add("timeSource", pic.timeSource)
+	pic.xmp.addTo(jf)
+	pic.iptc.addTo(jf)
+	if isVideoFile(pic.source) {
+		if pic.video == nil {
+			if pic.err != nil {
+				jf.Add("error", pic.err.Error())
+			}
+			return jf
+		}
+		return pic.video.addTo(jf)
+	}
+	jf.AddRaw("orientation", fmt.Sprintf("%d", pic.orientation))
+	w, h, err := imageSize(pic)
+	if err != nil {
+		jf.Add("error", err.Error())
+		return jf
+	}
+	tw, th, small := opts.effectiveSize(w, h)
+	jf.AddRaw("width", fmt.Sprintf("%d", w))
+	jf.AddRaw("height", fmt.Sprintf("%d", h))
+	jf.AddRaw("thumbWidth", fmt.Sprintf("%d", tw))
+	jf.AddRaw("thumbHeight", fmt.Sprintf("%d", th))
+	jf.AddRaw("noUpscale", fmt.Sprintf("%t", small))
+	if small && canPassthrough(pic, opts) {
+		jf.Add("thumbSource", "original")
+	}
+	return jf
+}
+
+//
+// Add the meta data that needs the image to be decoded. palette is the number of palette colours (0 is no palette).
+// If placeholder is true the BlurHash of the thumbnail is added. The values are cached until the file changes.
+//
+func addDecodedMeta(jf *JsonFields, pic *Picture, opts *ThumbOptions, cache *MetaCache, palette int, placeholder bool) *JsonFields {
+	if isVideoFile(pic.source) {
+		return jf
+	}
+	if palette > 0 {
+		pal, err := picturePalette(pic, opts, cache, palette)
+		if err != nil {
+			return jf.Add("decodeError", err.Error())
+		}
+		jf.AddRaw("palette", pal)
+	}
+	if placeholder {
+		hash, err := cache.get(pic.source, optionsKey(fmt.Sprintf("blurhash orientation:%d", pic.orientation), opts), func() (string, error) {
+			img, _, err := createThumbImage(pic, "", opts, false, false, 0)
+			if err != nil {
+				return "", err
+			}
+			return blurHash(img), nil
+		})
+		if err != nil {
+			return jf.Add("decodeError", err.Error())
+		}
+		jf.Add("blurhash", hash)
+	}
+	return jf
+}
+
+//
+// meta/user/{user}/loc/{loc}/path/{path}/name/{name}
+//
+// Returns the meta data for an image or video as a json object. The thumbnail query options are applied.
+// palette=n adds the n dominant colours. placeholder=true adds the BlurHash of the thumbnail.
+//
+func metaHandler(uri []string, tns *TNServer, w http.ResponseWriter, r *http.Request) *TNResp {
+	location, resp := locationFromPath(uri, tns)
+	if resp != nil {
+		return resp
+	}
+	path, isDir, resp := filePathFromPath(uri, location, tns, true)
+	if resp != nil {
+		return resp
+	}
+	if isDir {
+		return BR("META", "is-dir", uri, nil)
+	}
+	_, ok := THUMB_FILE_TYPES[strings.ToLower(filepath.Ext(path))]
+	if !ok && !isVideoFile(path) {
+		_, fName := filepath.Split(path)
+		return UMT("META", fName, uri, nil)
+	}
+	thumbOptions, err := tns.thumbOptions.WithLocation(locationConfig(uri, tns)).WithQuery(r.URL.Query())
+	if err != nil {
+		return BR("META", err.Error(), uri, err)
+	}
+	palette, err := queryPalette(r)
+	if err != nil {
+		return BR("META", err.Error(), uri, err)
+	}
+	pic := NewPicture(path, true)
+	jf := addDecodedMeta(pictureMeta(pic, thumbOptions), pic, thumbOptions, tns.metaCache, palette, queryPlaceholder(r))
+	return &TNResp{returnCode: http.StatusOK, mimeType: MEDIA_JSON, resp: []byte(jf.String())}
+}
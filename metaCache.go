@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	META_CACHE_ARG = "metacache="
+)
+
+//
+// Per file meta data that needs the image to be decoded (palette, placeholder).
+// Values are kept until the file modified time or size changes.
+// When the cache is full an entry is removed to make room. A nil cache does not cache.
+//
+type MetaCache struct {
+	mu      sync.Mutex
+	entries map[string]*metaCacheEntry
+	max     int
+}
+
+type metaCacheEntry struct {
+	modTime time.Time
+	size    int64
+	values  map[string]string
+}
+
+func NewMetaCache(max int) *MetaCache {
+	if max <= 0 {
+		return nil
+	}
+	return &MetaCache{entries: make(map[string]*metaCacheEntry), max: max}
+}
+
+//
+// The value for key for the file. If it is not cached (or the file has changed) fn is called and the result is cached.
+// Errors are not cached.
+//
+func (c *MetaCache) get(source, key string, fn func() (string, error)) (string, error) {
+	if c == nil {
+		return fn()
+	}
+	stat, err := os.Stat(source)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	e, ok := c.entries[source]
+	if ok && e.modTime.Equal(stat.ModTime()) && e.size == stat.Size() {
+		v, found := e.values[key]
+		if found {
+			c.mu.Unlock()
+			return v, nil
+		}
+	}
+	c.mu.Unlock()
+
+	v, err := fn()
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok = c.entries[source]
+	if !ok || !e.modTime.Equal(stat.ModTime()) || e.size != stat.Size() {
+		if !ok && len(c.entries) >= c.max {
+			for k := range c.entries {
+				delete(c.entries, k)
+				break
+			}
+		}
+		e = &metaCacheEntry{modTime: stat.ModTime(), size: stat.Size(), values: make(map[string]string)}
+		c.entries[source] = e
+	}
+	e.values[key] = v
+	return v, nil
+}
+
+func (c *MetaCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
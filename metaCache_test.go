@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetaCache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.jpg")
+	os.WriteFile(file, []byte("one"), 0644)
+	calls := 0
+	fn := func() (string, error) {
+		calls++
+		return "value", nil
+	}
+	cache := NewMetaCache(1)
+	cache.get(file, "k", fn)
+	v, err := cache.get(file, "k", fn)
+	if err != nil || v != "value" || calls != 1 {
+		t.Fatalf("Failed: id:001 value:%s calls:%d", v, calls)
+	}
+	// A different key for the same file is computed
+	cache.get(file, "k2", fn)
+	if calls != 2 || cache.len() != 1 {
+		t.Fatalf("Failed: id:002 calls:%d len:%d", calls, cache.len())
+	}
+	// The file changed so the value is computed again
+	os.WriteFile(file, []byte("changed"), 0644)
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Hour))
+	cache.get(file, "k", fn)
+	if calls != 3 {
+		t.Fatalf("Failed: id:003 calls:%d", calls)
+	}
+	// Full. Another file replaces the entry
+	other := filepath.Join(dir, "b.jpg")
+	os.WriteFile(other, []byte("two"), 0644)
+	cache.get(other, "k", fn)
+	if cache.len() != 1 {
+		t.Fatalf("Failed: id:004 len:%d", cache.len())
+	}
+	// Errors are not cached
+	_, err = cache.get(file, "e", func() (string, error) { return "", errors.New("bad") })
+	if err == nil {
+		t.Fatalf("Failed: id:005 error expected")
+	}
+	_, err = cache.get(file, "e", fn)
+	if err != nil || calls != 5 {
+		t.Fatalf("Failed: id:006 calls:%d", calls)
+	}
+	// No cache. Always computed
+	var none *MetaCache
+	none.get(file, "k", fn)
+	none.get(file, "k", fn)
+	if calls != 7 || NewMetaCache(0) != nil {
+		t.Fatalf("Failed: id:007 calls:%d", calls)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stuartdd2/JsonParser4go/parser"
+)
+
+//
+// A rule for deriving a date time from a file name.
+// The regex is matched against the file name (without the suffix).
+// If the regex has capture groups the groups are joined and parsed using layout.
+// If the regex has no capture groups the whole match is parsed using layout.
+//
+type NameTimeRule struct {
+	name   string
+	regex  *regexp.Regexp
+	layout string
+}
+
+var (
+	TIME_RULES_PATH = parser.NewDotPath("resources.timeRules")
+
+	nameTimeRules = []*NameTimeRule{
+		// IMG_20200102_150405, VID_20200102_150405, PXL_20210304_101112345
+		mustNameTimeRule("YYYYMMDD_HHMMSS", `(?:^|\D)(\d{8}_\d{6})`, "20060102_150405"),
+		// 20200102-150405
+		mustNameTimeRule("YYYYMMDD-HHMMSS", `(?:^|\D)(\d{8}-\d{6})`, "20060102-150405"),
+		// Screenshot_2021-05-06-07-08-09
+		mustNameTimeRule("YYYY-MM-DD-HH-MM-SS", `(\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-\d{2})`, "2006-01-02-15-04-05"),
+		// Screenshot_2021-05-06_07-08-09
+		mustNameTimeRule("YYYY-MM-DD_HH-MM-SS", `(\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2})`, "2006-01-02_15-04-05"),
+		// 2021-05-06 07.08.09
+		mustNameTimeRule("YYYY-MM-DD HH.MM.SS", `(\d{4}-\d{2}-\d{2} \d{2}\.\d{2}\.\d{2})`, "2006-01-02 15.04.05"),
+		// Screenshot 2021-05-06 at 07.08.09
+		mustNameTimeRule("YYYY-MM-DD at HH.MM.SS", `(\d{4}-\d{2}-\d{2}) at (\d{2}\.\d{2}\.\d{2})`, "2006-01-0215.04.05"),
+		// IMG-20200102-WA0001
+		mustNameTimeRule("WhatsApp", `(?:^|\D)(\d{8})-WA\d+`, "20060102"),
+		// DSC20200102150405
+		mustNameTimeRule("YYYYMMDDHHMMSS", `(?:^|\D)(\d{14})(?:\D|$)`, "20060102150405"),
+	}
+)
+
+func NewNameTimeRule(name, regex, layout string) (*NameTimeRule, error) {
+	if strings.TrimSpace(layout) == "" {
+		return nil, fmt.Errorf("time rule '%s' has an empty layout", name)
+	}
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, fmt.Errorf("time rule '%s' regex is invalid %s", name, err.Error())
+	}
+	if name == "" {
+		name = regex
+	}
+	return &NameTimeRule{name: name, regex: re, layout: layout}, nil
+}
+
+func mustNameTimeRule(name, regex, layout string) *NameTimeRule {
+	r, err := NewNameTimeRule(name, regex, layout)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+//
+// Return the time derived from the name. false is returned if the rule does not match.
+//
+func (r *NameTimeRule) Parse(name string) (time.Time, bool) {
+	m := r.regex.FindStringSubmatch(name)
+	if m == nil {
+		return time.Now(), false
+	}
+	s := m[0]
+	if len(m) > 1 {
+		s = strings.Join(m[1:], "")
+	}
+	t, err := time.Parse(r.layout, s)
+	if err != nil {
+		return time.Now(), false
+	}
+	return t, true
+}
+
+//
+// Derive a time from a file name (without suffix).
+// The existing full string formats are tried first, then each rule in order.
+//
+func timeParseName(name string) (time.Time, string, error) {
+	t, err := timeParseStr(name)
+	if err == nil {
+		return t, "NAME", nil
+	}
+	for _, r := range nameTimeRules {
+		t, ok := r.Parse(name)
+		if ok {
+			return t, "NAME:" + r.name, nil
+		}
+	}
+	return time.Now(), "", fmt.Errorf("no time rule matched name '%s'", name)
+}
+
+//
+// Read user defined rules from the config data. User rules are tried before the built in rules.
+//
+//    "timeRules": [
+//        {"name": "MyCam", "regex": "^CAM(\\d{8})", "layout": "20060102"}
+//    ]
+//
+func loadNameTimeRules(configData parser.NodeC) error {
+	rulesNode, err := parser.Find(configData, TIME_RULES_PATH)
+	if err != nil {
+		return nil
+	}
+	rulesList, ok := rulesNode.(*parser.JsonList)
+	if !ok {
+		return fmt.Errorf("config data node %s is not a json list", TIME_RULES_PATH)
+	}
+	userRules := make([]*NameTimeRule, 0)
+	for i, rn := range rulesList.GetValues() {
+		ro, ok := rn.(*parser.JsonObject)
+		if !ok {
+			return fmt.Errorf("config data node %s[%d] is not a json object", TIME_RULES_PATH, i)
+		}
+		r, err := NewNameTimeRule(configString(ro, "name", ""), configString(ro, "regex", ""), configString(ro, "layout", ""))
+		if err != nil {
+			return err
+		}
+		userRules = append(userRules, r)
+	}
+	nameTimeRules = append(userRules, nameTimeRules...)
+	return nil
+}
+
+func configString(obj *parser.JsonObject, name, def string) string {
+	n := obj.GetNodeWithName(name)
+	if n == nil {
+		return def
+	}
+	s, ok := n.(*parser.JsonString)
+	if !ok {
+		return def
+	}
+	return s.GetValue()
+}
+
+//
+// A string, number or bool value as a string. def if not found.
+//
+func configValue(obj *parser.JsonObject, name, def string) string {
+	n := obj.GetNodeWithName(name)
+	switch v := n.(type) {
+	case *parser.JsonString:
+		return v.GetValue()
+	case *parser.JsonNumber:
+		return strconv.FormatFloat(v.GetValue(), 'f', -1, 64)
+	case *parser.JsonBool:
+		return strconv.FormatBool(v.GetValue())
+	}
+	return def
+}
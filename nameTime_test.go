@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stuartdd2/JsonParser4go/parser"
+)
+
+func TestTimeParseName(t *testing.T) {
+	assertTPN(t, "001", "20200102_150405", "2020-01-02T15:04:05", "NAME")
+	assertTPN(t, "002", "IMG_20200102_150405", "2020-01-02T15:04:05", "NAME:YYYYMMDD_HHMMSS")
+	assertTPN(t, "003", "PXL_20210304_101112345", "2021-03-04T10:11:12", "NAME:YYYYMMDD_HHMMSS")
+	assertTPN(t, "004", "Screenshot_2021-05-06-07-08-09", "2021-05-06T07:08:09", "NAME:YYYY-MM-DD-HH-MM-SS")
+	assertTPN(t, "005", "IMG-20200102-WA0001", "2020-01-02T00:00:00", "NAME:WhatsApp")
+	assertTPN(t, "006", "Screenshot 2021-05-06 at 07.08.09", "2021-05-06T07:08:09", "NAME:YYYY-MM-DD at HH.MM.SS")
+	assertTPN(t, "007", "2021-05-06 07.08.09", "2021-05-06T07:08:09", "NAME:YYYY-MM-DD HH.MM.SS")
+	assertTPN(t, "008", "IMG_20201302_150405", "", "")
+	assertTPN(t, "009", "myPic", "", "")
+}
+
+func TestLoadNameTimeRules(t *testing.T) {
+	saved := nameTimeRules
+	defer func() { nameTimeRules = saved }()
+	configData, err := parser.Parse([]byte(`{"resources":{"timeRules":[{"name":"MyCam","regex":"^CAM(\\d{8})","layout":"20060102"}]}}`))
+	if err != nil {
+		t.Fatalf("Parse failed %s", err.Error())
+	}
+	err = loadNameTimeRules(configData)
+	if err != nil {
+		t.Fatalf("Load failed %s", err.Error())
+	}
+	assertTPN(t, "001", "CAM20190708x", "2019-07-08T00:00:00", "NAME:MyCam")
+	assertTPN(t, "002", "IMG_20200102_150405", "2020-01-02T15:04:05", "NAME:YYYYMMDD_HHMMSS")
+
+	configData, _ = parser.Parse([]byte(`{"resources":{"timeRules":[{"regex":"(","layout":"20060102"}]}}`))
+	err = loadNameTimeRules(configData)
+	if err == nil {
+		t.Fatalf("Invalid regex should return an error")
+	}
+}
+
+func assertTPN(t *testing.T, id, name, expected, expectedSource string) {
+	tim, src, err := timeParseName(name)
+	if expected == "" {
+		if err == nil {
+			t.Fatalf("Failed: id:%s name:%s should not match. Matched %s", id, name, src)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Failed: id:%s name:%s error:%s", id, name, err.Error())
+	}
+	if tim.Format(TIME_FORMAT_2) != expected || src != expectedSource {
+		t.Fatalf("Failed: id:%s expected:%s (%s) actual:%s (%s)", id, expected, expectedSource, tim.Format(TIME_FORMAT_2), src)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PALETTE_ARG = "palette="
+
+	PALETTE_MAX    = 16
+	PALETTE_SAMPLE = 64 // The palette is computed from a thumbnail with this short side
+)
+
+//
+// A colour in the palette. fraction is the fraction (0..1) of the image pixels it represents.
+//
+type PaletteColour struct {
+	colour   color.RGBA
+	fraction float64
+}
+
+//
+// A box of pixels for median cut.
+//
+type paletteBox struct {
+	pixels [][3]uint8
+}
+
+func validPalette(name, value string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 || n > PALETTE_MAX {
+		return 0, fmt.Errorf("%s%s is invalid. Use 0 to %d", name, value, PALETTE_MAX)
+	}
+	return n, nil
+}
+
+//
+// The n dominant colours of the opaque pixels in the image using median cut. Sorted by fraction, largest first.
+// The box with the widest range of a single channel is split at the median of that channel until there are n boxes.
+// Each colour is the average of the pixels in its box.
+//
+func palette(img *image.RGBA, n int) []PaletteColour {
+	all := make([][3]uint8, 0, len(img.Pix)/4)
+	forEachPixel(img, func(p []uint8) {
+		if p[3] == 255 {
+			all = append(all, [3]uint8{p[0], p[1], p[2]})
+		}
+	})
+	if len(all) == 0 || n <= 0 {
+		return []PaletteColour{}
+	}
+	boxes := []*paletteBox{{pixels: all}}
+	for len(boxes) < n {
+		best, channel, widest := -1, 0, 0
+		for i, b := range boxes {
+			c, r := b.widestChannel()
+			if r > widest {
+				best, channel, widest = i, c, r
+			}
+		}
+		if best < 0 {
+			// All boxes are a single colour
+			break
+		}
+		px := boxes[best].pixels
+		sort.Slice(px, func(i, j int) bool { return px[i][channel] < px[j][channel] })
+		// Split at the median value so pixels with the same value stay in the same box
+		mid := len(px) / 2
+		v := px[mid][channel]
+		mid = sort.Search(len(px), func(i int) bool { return px[i][channel] >= v })
+		if mid == 0 {
+			mid = sort.Search(len(px), func(i int) bool { return px[i][channel] > v })
+		}
+		boxes[best] = &paletteBox{pixels: px[:mid]}
+		boxes = append(boxes, &paletteBox{pixels: px[mid:]})
+	}
+	pal := make([]PaletteColour, 0, len(boxes))
+	for _, b := range boxes {
+		var sum [3]int
+		for _, p := range b.pixels {
+			sum[0] += int(p[0])
+			sum[1] += int(p[1])
+			sum[2] += int(p[2])
+		}
+		c := len(b.pixels)
+		pal = append(pal, PaletteColour{colour: color.RGBA{R: uint8((sum[0] + c/2) / c), G: uint8((sum[1] + c/2) / c), B: uint8((sum[2] + c/2) / c), A: 255}, fraction: float64(c) / float64(len(all))})
+	}
+	sort.SliceStable(pal, func(i, j int) bool { return pal[i].fraction > pal[j].fraction })
+	return pal
+}
+
+//
+// The channel (0 = R, 1 = G, 2 = B) with the widest range of values and the range.
+// The range is 0 if the box has less than 2 pixels.
+//
+func (b *paletteBox) widestChannel() (int, int) {
+	if len(b.pixels) < 2 {
+		return 0, 0
+	}
+	lo := b.pixels[0]
+	hi := b.pixels[0]
+	for _, p := range b.pixels {
+		for c := 0; c < 3; c++ {
+			if p[c] < lo[c] {
+				lo[c] = p[c]
+			}
+			if p[c] > hi[c] {
+				hi[c] = p[c]
+			}
+		}
+	}
+	channel, r := 0, 0
+	for c := 0; c < 3; c++ {
+		if int(hi[c])-int(lo[c]) > r {
+			channel, r = c, int(hi[c])-int(lo[c])
+		}
+	}
+	return channel, r
+}
+
+//
+// The palette as a json list. For example [{"colour":"#a0b0c0","fraction":0.42}]
+//
+func paletteJson(pal []PaletteColour) string {
+	list := make([]string, len(pal))
+	for i, p := range pal {
+		list[i] = NewJsonFields().Add("colour", colourString(p.colour)).AddRaw("fraction", strconv.FormatFloat(p.fraction, 'f', 3, 64)).String()
+	}
+	return "[" + strings.Join(list, ",") + "]"
+}
+
+//
+// The options for the small thumbnail the palette is computed from.
+// Only the options that change the colours of the image are kept.
+//
+func paletteOptions(opts *ThumbOptions) *ThumbOptions {
+	po := NewThumbOptions(PALETTE_SAMPLE)
+	po.limits = opts.limits
+	po.preview = true
+	po.icc = opts.icc
+	po.background = opts.background
+	return po
+}
+
+//
+// The palette json for an image. The result is cached until the file changes.
+//
+func picturePalette(pic *Picture, opts *ThumbOptions, cache *MetaCache, n int) (string, error) {
+	return cache.get(pic.source, fmt.Sprintf("palette:%d icc:%t background:%s", n, opts.icc, colourString(opts.background)), func() (string, error) {
+		img, _, err := createThumbImage(pic, "", paletteOptions(opts), false, false, 0)
+		if err != nil {
+			return "", err
+		}
+		return paletteJson(palette(img, n)), nil
+	})
+}
+
+//
+// The number of palette colours from the palette= query parameter. 0 if not given.
+//
+func queryPalette(r *http.Request) (int, error) {
+	p := strings.TrimSpace(r.URL.Query().Get("palette"))
+	if p == "" {
+		return 0, nil
+	}
+	return validPalette("palette=", p)
+}
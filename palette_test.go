@@ -0,0 +1,39 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestPalette(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, image.Rect(0, 0, 10, 7), image.NewUniform(color.RGBA{R: 200, G: 10, B: 10, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 7, 10, 10), image.NewUniform(color.RGBA{R: 10, G: 10, B: 200, A: 255}), image.Point{}, draw.Src)
+	pal := palette(img, 2)
+	if len(pal) != 2 {
+		t.Fatalf("Failed: id:001 len:%d", len(pal))
+	}
+	if pal[0].colour != (color.RGBA{R: 200, G: 10, B: 10, A: 255}) || pal[0].fraction != 0.7 {
+		t.Fatalf("Failed: id:002 first:%v %g", pal[0].colour, pal[0].fraction)
+	}
+	if pal[1].colour != (color.RGBA{R: 10, G: 10, B: 200, A: 255}) || pal[1].fraction != 0.3 {
+		t.Fatalf("Failed: id:003 second:%v %g", pal[1].colour, pal[1].fraction)
+	}
+	// Only 2 colours so only 2 boxes
+	if len(palette(img, 5)) != 2 {
+		t.Fatalf("Failed: id:004 a 2 colour image should have a palette of 2")
+	}
+	if paletteJson(pal) != `[{"colour":"#c80a0a","fraction":0.700},{"colour":"#0a0ac8","fraction":0.300}]` {
+		t.Fatalf("Failed: id:005 json:%s", paletteJson(pal))
+	}
+	// Transparent pixels are ignored
+	if len(palette(image.NewRGBA(image.Rect(0, 0, 4, 4)), 3)) != 0 {
+		t.Fatalf("Failed: id:006 transparent image should have an empty palette")
+	}
+	_, err := validPalette("palette=", "17")
+	if err == nil {
+		t.Fatalf("Failed: id:007 palette=17 should be invalid")
+	}
+}
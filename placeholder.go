@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	INDEX_ARG = "index="
+
+	BLURHASH_CHARS      = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	BLURHASH_LONG       = 4  // Components on the long side of the image
+	BLURHASH_SHORT      = 3  // Components on the short side of the image
+	BLURHASH_SAMPLE     = 32 // The image is scaled so the long side is this size before it is hashed
+	PLACEHOLDER_LQIP    = 16 // Long side of the data uri image
+	PLACEHOLDER_QUALITY = 50
+)
+
+//
+// The BlurHash (https://blurha.sh) of an image. A short string that a browser can decode to a blurred placeholder.
+// The thumbnail is scaled down before it is hashed so the cost does not depend on the thumbnail size.
+//
+func blurHash(img *image.RGBA) string {
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return ""
+	}
+	xc, yc := BLURHASH_LONG, BLURHASH_SHORT
+	if b.Dy() > b.Dx() {
+		xc, yc = BLURHASH_SHORT, BLURHASH_LONG
+	}
+	w, h := b.Dx(), b.Dy()
+	if w > BLURHASH_SAMPLE || h > BLURHASH_SAMPLE {
+		w, h = longSideSize(w, h, BLURHASH_SAMPLE)
+		img = resample(img, w, h, FILTER_BILINEAR)
+	}
+
+	var lin [256]float64
+	for v := range lin {
+		lin[v] = srgbToLinear(float64(v) / 255)
+	}
+	factors := make([][3]float64, 0, xc*yc)
+	for j := 0; j < yc; j++ {
+		for i := 0; i < xc; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				by := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				row := img.Pix[img.PixOffset(0, y):]
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * by
+					p := row[x*4 : x*4+3]
+					f[0] += basis * lin[p[0]]
+					f[1] += basis * lin[p[1]]
+					f[2] += basis * lin[p[2]]
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	base83(&sb, (xc-1)+(yc-1)*9, 1)
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		base83(&sb, quantisedMax, 1)
+	} else {
+		base83(&sb, 0, 1)
+	}
+	dc := factors[0]
+	base83(&sb, blurHashByte(dc[0])<<16+blurHashByte(dc[1])<<8+blurHashByte(dc[2]), 4)
+	for _, f := range factors[1:] {
+		q := func(v float64) int {
+			sp := math.Copysign(math.Sqrt(math.Abs(v/maxValue)), v)
+			return int(math.Max(0, math.Min(18, math.Floor(sp*9+9.5))))
+		}
+		base83(&sb, q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return sb.String()
+}
+
+func blurHashByte(linear float64) int {
+	return int(math.Round(linearToSrgb(math.Min(math.Max(linear, 0), 1)) * 255))
+}
+
+func base83(sb *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(BLURHASH_CHARS[digit])
+	}
+}
+
+//
+// A tiny jpg of the thumbnail as a data uri. It can be used directly in an img src while the thumbnail loads.
+//
+func placeholderDataUri(img *image.RGBA) (string, error) {
+	w, h := longSideSize(img.Bounds().Dx(), img.Bounds().Dy(), PLACEHOLDER_LQIP)
+	buf := NewEncodedWriter(1000)
+	err := jpeg.Encode(buf, resample(img, w, h, FILTER_BILINEAR), &jpeg.Options{Quality: PLACEHOLDER_QUALITY})
+	if err != nil {
+		return "", err
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+//
+// Scale w x h so the long side is max. Each side is at least 1.
+//
+func longSideSize(w, h, max int) (int, int) {
+	if w >= h {
+		return max, maxInt(int(math.Round(float64(h)*float64(max)/float64(w))), 1)
+	}
+	return maxInt(int(math.Round(float64(w)*float64(max)/float64(h))), 1), max
+}
+
+//
+// The placeholder for an image. The thumbnail is created using opts and then hashed.
+// width and height are the size of the thumbnail so the page can reserve the space.
+//
+func picturePlaceholder(pic *Picture, opts *ThumbOptions, dataUri bool) (*JsonFields, error) {
+	img, info, err := createThumbImage(pic, "", opts, false, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	jf := NewJsonFields()
+	jf.Add("name", pic.GetFileName())
+	jf.AddRaw("width", fmt.Sprintf("%d", info.width))
+	jf.AddRaw("height", fmt.Sprintf("%d", info.height))
+	jf.Add("blurhash", blurHash(img))
+	if dataUri {
+		uri, err := placeholderDataUri(img)
+		if err != nil {
+			return nil, err
+		}
+		jf.Add("dataUri", uri)
+	}
+	return jf, nil
+}
+
+//
+// A cache key for a value that depends on the thumbnail options.
+//
+func optionsKey(name string, opts *ThumbOptions) string {
+	return name + ":" + opts.String() + " watermark:" + opts.watermark.String()
+}
+
+//
+// placeholder/user/{user}/loc/{loc}/path/{path}/name/{name}
+//
+// Returns the BlurHash and a tiny data uri image for an image as a json object. The thumbnail query options are applied.
+//
+func placeholderHandler(uri []string, tns *TNServer, w http.ResponseWriter, r *http.Request) *TNResp {
+	location, resp := locationFromPath(uri, tns)
+	if resp != nil {
+		return resp
+	}
+	path, isDir, resp := filePathFromPath(uri, location, tns, true)
+	if resp != nil {
+		return resp
+	}
+	if isDir {
+		return BR("PLACEHOLDER", "is-dir", uri, nil)
+	}
+	_, ok := THUMB_FILE_TYPES[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		_, fName := filepath.Split(path)
+		return UMT("PLACEHOLDER", fName, uri, nil)
+	}
+	thumbOptions, err := tns.thumbOptions.WithLocation(locationConfig(uri, tns)).WithQuery(r.URL.Query())
+	if err != nil {
+		return BR("PLACEHOLDER", err.Error(), uri, err)
+	}
+	pic := NewPicture(path, true)
+	js, err := tns.metaCache.get(path, optionsKey(fmt.Sprintf("placeholder orientation:%d", pic.orientation), thumbOptions), func() (string, error) {
+		jf, err := picturePlaceholder(pic, thumbOptions, true)
+		if err != nil {
+			return "", err
+		}
+		return jf.String(), nil
+	})
+	if err != nil {
+		return thumbErrorResp(pic, uri, err)
+	}
+	return &TNResp{returnCode: http.StatusOK, mimeType: MEDIA_JSON, resp: []byte(js)}
+}
+
+//
+// Index of the thumbnails created by a batch run. Written as a json list when the run completes.
+//
+type ThumbIndex struct {
+	fileName string
+	srcPath  string
+	dstPath  string
+	entries  []string
+}
+
+func NewThumbIndex(fileName, srcPath, dstPath string) *ThumbIndex {
+	return &ThumbIndex{fileName: fileName, srcPath: srcPath, dstPath: dstPath, entries: make([]string, 0)}
+}
+
+//
+// Add a thumbnail to the index. The thumbnail file is read so thumbnails skipped by noclobber are included.
+// Videos copied by video=copy are not images so they are not added.
+//
+func (ti *ThumbIndex) add(srcFile, thumbFile string) {
+	if ti == nil || thumbFile == "" || isVideoFile(thumbFile) {
+		return
+	}
+	f, err := os.Open(thumbFile)
+	if err != nil {
+		logServer("INDEX", thumbFile, err)
+		return
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		logServer("INDEX", thumbFile, err)
+		return
+	}
+	rgba := toRGBA(img)
+	src, _ := filepath.Rel(ti.srcPath, srcFile)
+	dst, _ := filepath.Rel(ti.dstPath, thumbFile)
+	jf := NewJsonFields()
+	jf.Add("source", filepath.ToSlash(src))
+	jf.Add("thumb", filepath.ToSlash(dst))
+	jf.AddRaw("width", fmt.Sprintf("%d", rgba.Bounds().Dx()))
+	jf.AddRaw("height", fmt.Sprintf("%d", rgba.Bounds().Dy()))
+	jf.Add("blurhash", blurHash(rgba))
+	ti.entries = append(ti.entries, jf.String())
+}
+
+func (ti *ThumbIndex) write() error {
+	if ti == nil {
+		return nil
+	}
+	if len(ti.entries) == 0 {
+		return os.WriteFile(ti.fileName, []byte("[]\n"), 0644)
+	}
+	return os.WriteFile(ti.fileName, []byte("[\n  "+strings.Join(ti.entries, ",\n  ")+"\n]\n"), 0644)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlurHash(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	draw.Draw(red, red.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	// 4 x 3 components (L). The DC (average colour) is FF0000 (TI:j). 11 AC values of 2 characters
+	h := blurHash(red)
+	if len(h) != 28 || h[0] != 'L' || h[2:6] != "TI:j" {
+		t.Fatalf("Failed: id:001 hash:%s", h)
+	}
+	// Portrait images have 3 x 4 components. Large images are scaled before hashing
+	h = blurHash(testImage(30, 400))
+	if len(h) != 28 || h[0] != 'T' {
+		t.Fatalf("Failed: id:002 hash:%s", h)
+	}
+	if w, h := longSideSize(400, 30, 32); w != 32 || h != 2 {
+		t.Fatalf("Failed: id:003 size:%dx%d", w, h)
+	}
+	uri, err := placeholderDataUri(testImage(40, 20))
+	if err != nil || !strings.HasPrefix(uri, "data:image/jpeg;base64,/9j/") {
+		t.Fatalf("Failed: id:004 uri:%s err:%v", uri, err)
+	}
+}
+
+func TestThumbIndex(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	srcFile := filepath.Join(srcDir, "test.png")
+	f, err := os.Create(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, testImage(40, 20))
+	f.Close()
+
+	index := NewThumbIndex(filepath.Join(dstDir, "index.json"), srcDir, dstDir)
+	thumbFile := thumb(srcFile, dstDir, "%n.%x", NewThumbOptions(10), false, false)
+	if thumbFile != filepath.Join(dstDir, "test.jpg") {
+		t.Fatalf("Failed: id:001 thumb file:%s", thumbFile)
+	}
+	index.add(srcFile, thumbFile)
+	index.add(srcFile, "")
+	videoFile := filepath.Join(srcDir, "clip.mp4")
+	writeTestVideo(t, videoFile, testVideoBox("moov", testVideoMvhd(0, 0, 600, 600)))
+	opts := NewThumbOptions(10)
+	opts.video = VIDEO_COPY
+	copied := thumb(videoFile, dstDir, "%n.%x", opts, false, false)
+	index.add(videoFile, copied)
+	if copied == "" || len(index.entries) != 1 {
+		t.Fatalf("Failed: id:004 a copied video should not be indexed. entries:%d", len(index.entries))
+	}
+	err = index.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dstDir, "index.json"))
+	if !strings.HasPrefix(string(data), "[\n  {\"source\":\"test.png\",\"thumb\":\"test.jpg\",\"width\":20,\"height\":10,\"blurhash\":\"L") {
+		t.Fatalf("Failed: id:002 index:%s", string(data))
+	}
+	var none *ThumbIndex
+	none.add(srcFile, thumbFile)
+	if none.write() != nil {
+		t.Fatalf("Failed: id:003 nil index should not write")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+)
+
+//
+// Return the EXIF embedded JPEG thumbnail (preview) if it can be used instead of decoding the whole image.
+//
+// It can be used if:
+//    It has the same aspect ratio as the image. Some cameras add black bars to the preview.
+//    It is big enough to create the thumbnail without scaling up.
+//
+// The scale returned is the image width / preview width. nil is returned if the preview cannot be used.
+//
+func previewImage(pic *Picture, opts *ThumbOptions) (img image.Image, scale float64) {
+	if pic.exif == nil {
+		return nil, 0
+	}
+	defer func() {
+		// JpegThumbnail does not check the offsets against the data length
+		if r := recover(); r != nil {
+			logServer("PREVIEW", pic.source, fmt.Errorf("%v", r))
+			img, scale = nil, 0
+		}
+	}()
+	data, err := pic.exif.JpegThumbnail()
+	if err != nil {
+		return nil, 0
+	}
+	pcfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || pcfg.Width < 1 || pcfg.Height < 1 {
+		return nil, 0
+	}
+	f, err := openImage(pic.source)
+	if err != nil {
+		return nil, 0
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil || cfg.Width < 1 || cfg.Height < 1 {
+		return nil, 0
+	}
+
+	// The preview is only decoded if it can be used
+	pAspect := float64(pcfg.Width) / float64(pcfg.Height)
+	iAspect := float64(cfg.Width) / float64(cfg.Height)
+	if math.Abs(pAspect/iAspect-1) > 0.02 {
+		return nil, 0
+	}
+	uw, uh := orientedSize(pcfg.Width, pcfg.Height, pic.orientation)
+	crop := opts.cropRect(uw, uh)
+	sw, sh := opts.scaleSize(crop.Dx(), crop.Dy())
+	if sw > crop.Dx() || sh > crop.Dy() {
+		return nil, 0
+	}
+	pv, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil || pv.Bounds().Dx() != pcfg.Width || pv.Bounds().Dy() != pcfg.Height {
+		return nil, 0
+	}
+	return pv, float64(cfg.Width) / float64(pcfg.Width)
+}
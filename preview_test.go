@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//
+// Write an 80x40 jpg with an EXIF APP1 segment. IFD1 has a w x h jpg thumbnail (preview).
+// If badLength is true the thumbnail length is past the end of the EXIF data.
+//
+func writeTestPreviewJpeg(t *testing.T, fileName string, w, h int, badLength bool) {
+	full := testRawJpeg(t, 80, 40, color.RGBA{R: 200, G: 200, B: 200, A: 255})
+	thumb := testRawJpeg(t, w, h, color.RGBA{R: 255, A: 255})
+	length := uint32(len(thumb))
+	if badLength {
+		length += 10000
+	}
+	out, offset := testTiffAppend([]byte{'I', 'I', 42, 0, 0, 0, 0, 0}, thumb)
+	out, ifd1 := testTiffIFD(out, []testTiffTag{testTiffShort(TIFF_COMPRESSION, 6), testTiffLong(TIFF_JPEG_OFFSET, offset), testTiffLong(TIFF_JPEG_LENGTH, length)}, 0)
+	out, ifd0 := testTiffIFD(out, []testTiffTag{testTiffShort(0x0112, 1)}, ifd1)
+	binary.LittleEndian.PutUint32(out[4:], ifd0)
+
+	seg := append([]byte("Exif\x00\x00"), out...)
+	data := append([]byte{}, full[:2]...)
+	data = append(data, 0xFF, 0xE1, byte((len(seg)+2)>>8), byte(len(seg)+2))
+	data = append(data, seg...)
+	data = append(data, full[2:]...)
+	err := os.WriteFile(fileName, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreviewImage(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "preview.jpg")
+	writeTestPreviewJpeg(t, fileName, 40, 20, false)
+	pic := NewPicture(fileName, true)
+	if pic.exif == nil {
+		t.Fatalf("Failed: id:001 the test file should have EXIF data %v", pic.err)
+	}
+
+	// 20x10 fits in the 40x20 preview. The image is 80 wide so the scale is 2
+	assertPreview(t, "002", pic, NewThumbOptions(10), 2)
+	assertPreview(t, "003", pic, NewThumbOptions(20), 2)
+	// 42x21 is bigger than the preview
+	assertPreview(t, "004", pic, NewThumbOptions(21), 0)
+
+	// fit=cover crops the 40x20 preview to 20x20
+	opts := NewThumbOptions(10)
+	opts.fit, opts.width, opts.height = FIT_COVER, 20, 20
+	assertPreview(t, "005", pic, opts, 2)
+	opts.width, opts.height = 21, 21
+	assertPreview(t, "006", pic, opts, 0)
+
+	// The crop is reported in image coordinates (X-Thumb-Crop)
+	opts = NewThumbOptions(10)
+	opts.fit, opts.width, opts.height, opts.preview = FIT_COVER, 10, 10, true
+	_, info, err := createThumbImage(pic, "", opts, false, false, 0)
+	if err != nil || !info.preview {
+		t.Fatalf("Failed: id:007 the preview should be used. error:%v", err)
+	}
+	if info.CropString() != "20,0,40,40" {
+		t.Fatalf("Failed: id:008 crop:%s", info.CropString())
+	}
+	opts.preview = false
+	_, info, err = createThumbImage(pic, "", opts, false, false, 0)
+	if err != nil || info.preview || info.CropString() != "20,0,40,40" {
+		t.Fatalf("Failed: id:009 preview:%t crop:%s error:%v", info.preview, info.CropString(), err)
+	}
+
+	// A preview with a different aspect ratio (black bars) is not used
+	fileName = filepath.Join(dir, "bars.jpg")
+	writeTestPreviewJpeg(t, fileName, 40, 24, false)
+	assertPreview(t, "010", NewPicture(fileName, true), NewThumbOptions(10), 0)
+
+	// The preview length is past the end of the EXIF data. JpegThumbnail panics
+	fileName = filepath.Join(dir, "bad.jpg")
+	writeTestPreviewJpeg(t, fileName, 40, 20, true)
+	assertPreview(t, "011", NewPicture(fileName, true), NewThumbOptions(10), 0)
+
+	// No EXIF data
+	fileName = filepath.Join(dir, "none.jpg")
+	writeTestXmpJpeg(t, fileName, testXmpElements)
+	assertPreview(t, "012", NewPicture(fileName, true), NewThumbOptions(10), 0)
+}
+
+//
+// scale 0 expects the preview not to be used.
+//
+func assertPreview(t *testing.T, id string, pic *Picture, opts *ThumbOptions, scale float64) {
+	img, s := previewImage(pic, opts)
+	if scale == 0 {
+		if img != nil || s != 0 {
+			t.Fatalf("Failed: id:%s the preview should not be used. scale:%f", id, s)
+		}
+		return
+	}
+	if img == nil || s != scale {
+		t.Fatalf("Failed: id:%s expected scale:%f actual:%f", id, scale, s)
+	}
+}
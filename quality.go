@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	QUALITY_ARG = "quality"
+	COUNT_ARG   = "count="
+
+	QUALITY_SAMPLE    = 512 // Scores are computed on an image with this long side so they can be compared
+	QUALITY_SHADOW    = 5   // Luminance at or below this is clipped shadow
+	QUALITY_HIGHLIGHT = 250 // Luminance at or above this is clipped highlight
+	QUALITY_COUNT     = 10  // Default number of images returned by the server
+	QUALITY_COUNT_MAX = 1000
+	QUALITY_DECIMALS  = 3
+)
+
+//
+// Scores used to find bad shots.
+//
+//    sharpness  The variance of the Laplacian of the luminance. Low values are blurred (out of focus or camera shake).
+//    brightness The mean luminance. 0..1.
+//    shadows    The fraction of pixels that are clipped black.
+//    highlights The fraction of pixels that are clipped white.
+//    exposure   0..1. 1 is a mid brightness with no clipping. Low values are under or over exposed.
+//
+type QualityScore struct {
+	sharpness  float64
+	brightness float64
+	shadows    float64
+	highlights float64
+	exposure   float64
+}
+
+//
+// Compute the scores for the opaque pixels in the image.
+//
+func qualityScore(img *image.RGBA) QualityScore {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	luma := make([]float64, w*h)
+	i := 0
+	forEachPixel(img, func(p []uint8) {
+		luma[i] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		i++
+	})
+	q := QualityScore{}
+	if w*h == 0 {
+		return q
+	}
+	sum := 0.0
+	for _, l := range luma {
+		sum += l
+		if l <= QUALITY_SHADOW {
+			q.shadows++
+		} else if l >= QUALITY_HIGHLIGHT {
+			q.highlights++
+		}
+	}
+	q.brightness = sum / float64(len(luma)) / 255
+	q.shadows /= float64(len(luma))
+	q.highlights /= float64(len(luma))
+	q.exposure = math.Max(0, 1-2*math.Abs(q.brightness-0.5)-q.shadows-q.highlights)
+
+	// 3 x 3 Laplacian (4 neighbours) of the inner pixels
+	var lsum, lsq float64
+	n := 0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			c := y*w + x
+			l := luma[c-1] + luma[c+1] + luma[c-w] + luma[c+w] - 4*luma[c]
+			lsum += l
+			lsq += l * l
+			n++
+		}
+	}
+	if n > 0 {
+		mean := lsum / float64(n)
+		q.sharpness = lsq/float64(n) - mean*mean
+	}
+	return q
+}
+
+//
+// The options for the image the scores are computed from. The long side is QUALITY_SAMPLE.
+// Small images are not scaled up as that would make them look blurred.
+//
+func qualityOptions(opts *ThumbOptions) *ThumbOptions {
+	qo := NewThumbOptions(QUALITY_SAMPLE)
+	qo.limits = opts.limits
+	qo.maxLong = QUALITY_SAMPLE
+	qo.noUpscale = true
+	return qo
+}
+
+//
+// The scores for an image. The result is cached until the file changes.
+//
+func pictureQuality(pic *Picture, opts *ThumbOptions, cache *MetaCache) (QualityScore, error) {
+	s, err := cache.get(pic.source, "quality", func() (string, error) {
+		img, _, err := createThumbImage(pic, "", qualityOptions(opts), false, false, 0)
+		if err != nil {
+			return "", err
+		}
+		return qualityScore(img).cacheString(), nil
+	})
+	if err != nil {
+		return QualityScore{}, err
+	}
+	return parseQualityScore(s)
+}
+
+func (q QualityScore) cacheString() string {
+	return fmt.Sprintf("%g %g %g %g %g", q.sharpness, q.brightness, q.shadows, q.highlights, q.exposure)
+}
+
+func parseQualityScore(s string) (QualityScore, error) {
+	q := QualityScore{}
+	_, err := fmt.Sscanf(s, "%g %g %g %g %g", &q.sharpness, &q.brightness, &q.shadows, &q.highlights, &q.exposure)
+	return q, err
+}
+
+func (q QualityScore) addTo(jf *JsonFields) *JsonFields {
+	score := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', QUALITY_DECIMALS, 64)
+	}
+	jf.AddRaw("sharpness", strconv.FormatFloat(q.sharpness, 'f', 1, 64))
+	jf.AddRaw("exposure", score(q.exposure))
+	jf.AddRaw("brightness", score(q.brightness))
+	jf.AddRaw("shadows", score(q.shadows))
+	jf.AddRaw("highlights", score(q.highlights))
+	return jf
+}
+
+//
+// A scored image. name is relative to the directory that was scored.
+//
+type qualityEntry struct {
+	name  string
+	score QualityScore
+}
+
+//
+// Score all images in dir and its sub directories. Sorted by sharpness, blurriest first.
+// Images that cannot be decoded are logged and left out.
+//
+func qualityList(dir string, opts *ThumbOptions, cache *MetaCache) []qualityEntry {
+	list := make([]qualityEntry, 0)
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		_, ok := THUMB_FILE_TYPES[strings.ToLower(filepath.Ext(p))]
+		if !ok {
+			return nil
+		}
+		q, err := pictureQuality(NewPicture(p, true), opts, cache)
+		if err != nil {
+			logServer("QUALITY", p, err)
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		list = append(list, qualityEntry{name: filepath.ToSlash(rel), score: q})
+		return nil
+	})
+	sort.SliceStable(list, func(i, j int) bool { return list[i].score.sharpness < list[j].score.sharpness })
+	return list
+}
+
+//
+// Write a json line to stdout with the scores for each image in srcPath. Blurriest first.
+// count limits the number of lines. 0 is all images.
+//
+func quality(srcPath string, opts *ThumbOptions, count int) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		q, err := pictureQuality(NewPicture(srcPath, true), opts, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, NewJsonFields().AddRaw("QUALITY", q.addTo(NewJsonFields().Add("file", srcPath)).String()).String())
+		return nil
+	}
+	for i, e := range qualityList(srcPath, opts, nil) {
+		if count > 0 && i >= count {
+			break
+		}
+		fmt.Fprintln(os.Stdout, NewJsonFields().AddRaw("QUALITY", e.score.addTo(NewJsonFields().Add("file", filepath.Join(srcPath, e.name))).String()).String())
+	}
+	return nil
+}
+
+//
+// quality/user/{user}/loc/{loc}/path/{path}?count=n
+//
+// Returns a json list of the n blurriest images in the location (or path within it) and its sub directories.
+//
+func qualityHandler(uri []string, tns *TNServer, w http.ResponseWriter, r *http.Request) *TNResp {
+	location, resp := locationFromPath(uri, tns)
+	if resp != nil {
+		return resp
+	}
+	path, isDir, resp := filePathFromPath(uri, location, tns, false)
+	if resp != nil {
+		return resp
+	}
+	if !isDir {
+		return BR("QUALITY", "not-dir", uri, nil)
+	}
+	count := QUALITY_COUNT
+	c := strings.TrimSpace(r.URL.Query().Get("count"))
+	if c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 || n > QUALITY_COUNT_MAX {
+			return BR("QUALITY", fmt.Sprintf("count=%s is invalid. Use 1 to %d", c, QUALITY_COUNT_MAX), uri, err)
+		}
+		count = n
+	}
+	list := qualityList(path, tns.thumbOptions.WithLocation(locationConfig(uri, tns)), tns.metaCache)
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i, e := range list {
+		if i >= count {
+			break
+		}
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString("\n  ")
+		sb.WriteString(e.score.addTo(NewJsonFields().Add("name", e.name)).String())
+	}
+	return &TNResp{returnCode: http.StatusOK, mimeType: MEDIA_JSON, resp: []byte(sb.String() + "\n]")}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkerImage(w, h, square int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(64)
+			if (x/square+y/square)%2 == 0 {
+				v = 192
+			}
+			img.SetRGBA(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestQualityScore(t *testing.T) {
+	sharp := qualityScore(checkerImage(64, 64, 4))
+	// Scale down and up again to blur the edges
+	blurred := qualityScore(resample(resample(checkerImage(64, 64, 4), 16, 16, FILTER_BILINEAR), 64, 64, FILTER_BILINEAR))
+	if sharp.sharpness <= blurred.sharpness*4 {
+		t.Fatalf("Failed: id:001 sharp:%g blurred:%g", sharp.sharpness, blurred.sharpness)
+	}
+	if sharp.brightness < 0.49 || sharp.brightness > 0.51 || sharp.exposure < 0.98 {
+		t.Fatalf("Failed: id:002 brightness:%g exposure:%g", sharp.brightness, sharp.exposure)
+	}
+	black := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(black, black.Bounds(), image.NewUniform(color.RGBA{A: 255}), image.Point{}, draw.Src)
+	q := qualityScore(black)
+	if q.shadows != 1 || q.exposure != 0 || q.sharpness != 0 {
+		t.Fatalf("Failed: id:003 %v", q)
+	}
+	p, err := parseQualityScore(sharp.cacheString())
+	if err != nil || p != sharp {
+		t.Fatalf("Failed: id:004 %v %v", p, err)
+	}
+}
+
+func TestQualityList(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	for name, img := range map[string]*image.RGBA{
+		"sharp.png":     checkerImage(64, 64, 2),
+		"sub/blurr.png": resample(resample(checkerImage(64, 64, 2), 8, 8, FILTER_BILINEAR), 64, 64, FILTER_BILINEAR),
+	} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		png.Encode(f, img)
+		f.Close()
+	}
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644)
+	list := qualityList(dir, NewThumbOptions(200), NewMetaCache(10))
+	if len(list) != 2 || list[0].name != "sub/blurr.png" || list[1].name != "sharp.png" {
+		t.Fatalf("Failed: id:001 %v", list)
+	}
+}
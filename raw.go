@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+const (
+	TIFF_COMPRESSION       = 0x0103
+	TIFF_STRIP_OFFSETS     = 0x0111
+	TIFF_STRIP_BYTE_COUNTS = 0x0117
+	TIFF_SUB_IFDS          = 0x014A
+	TIFF_JPEG_OFFSET       = 0x0201
+	TIFF_JPEG_LENGTH       = 0x0202
+
+	RAW_MAX_IFDS   = 32   // Stop looking for previews after this many IFDs
+	RAW_CACHE_SIZE = 1000 // The number of RAW files with a cached preview location
+)
+
+var (
+	// RAW camera files. These are TIFF files with one or more embedded jpg previews
+	RAW_FILE_TYPES = map[string]string{
+		".cr2": "image/x-canon-cr2",
+		".nef": "image/x-nikon-nef",
+		".arw": "image/x-sony-arw",
+		".dng": "image/x-adobe-dng",
+	}
+
+	// The offset and length of the preview in each RAW file. A thumbnail opens the image several times
+	// (colour model, limits, decode, icc) so the TIFF structure is only read once.
+	RAW_PREVIEW_CACHE = NewMetaCache(RAW_CACHE_SIZE)
+)
+
+func init() {
+	// So RAW files are thumbnailed and listed as images (see filesOfInterest)
+	for ext, mt := range RAW_FILE_TYPES {
+		THUMB_FILE_TYPES[ext] = mt
+		mime.AddExtensionType(ext, mt)
+		mime.AddExtensionType(strings.ToUpper(ext), mt)
+	}
+}
+
+func isRawFile(fileName string) bool {
+	_, ok := RAW_FILE_TYPES[strings.ToLower(filepath.Ext(fileName))]
+	return ok
+}
+
+//
+// The preview section of a RAW file. Closing it closes the file.
+//
+type rawPreviewReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r rawPreviewReader) Close() error {
+	return r.f.Close()
+}
+
+//
+// Open an image file for decoding. For RAW files the largest embedded jpg preview is returned.
+// The preview is read from the file as it is needed. It is not copied.
+//
+func openImage(source string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	if !isRawFile(source) {
+		return f, nil
+	}
+	var offset, length int64
+	loc, err := RAW_PREVIEW_CACHE.get(source, "rawPreview", func() (string, error) {
+		o, l, err := rawPreview(f)
+		return fmt.Sprintf("%d %d", o, l), err
+	})
+	if err == nil {
+		_, err = fmt.Sscanf(loc, "%d %d", &offset, &length)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rawPreviewReader{SectionReader: io.NewSectionReader(f, offset, length), f: f}, nil
+}
+
+//
+// Find the largest jpg preview in a TIFF structured RAW file.
+//
+// IFD0 and the IFDs chained from it are searched along with any SubIFDs. A preview is either:
+//    JPEGInterchangeFormat (0x0201) and JPEGInterchangeFormatLength (0x0202). NEF, ARW and DNG.
+//    A single strip with JPEG compression (6 or 7). CR2 full size preview and DNG previews.
+// Candidates that are not baseline or progressive jpg files (for example lossless jpg raw data) are ignored.
+// So are candidates that are not inside the file.
+//
+// The offset and length of the preview are returned.
+//
+func rawPreview(f *os.File) (int64, int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	var header [8]byte
+	_, err = io.ReadFull(f, header[:])
+	if err != nil {
+		return 0, 0, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0, 0, fmt.Errorf("raw file is not a TIFF file")
+	}
+	queue := []int64{int64(order.Uint32(header[4:]))}
+	seen := make(map[int64]bool)
+	var bestOffset, bestLength int64
+	bestArea := 0
+	for len(queue) > 0 && len(seen) < RAW_MAX_IFDS {
+		offset := queue[0]
+		queue = queue[1:]
+		if offset == 0 || seen[offset] {
+			continue
+		}
+		seen[offset] = true
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			continue
+		}
+		dir, next, err := tiff.DecodeDir(f, order)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, int64(uint32(next)))
+		tags := make(map[uint16]*tiff.Tag)
+		for _, t := range dir.Tags {
+			tags[t.Id] = t
+		}
+		if t, ok := tags[TIFF_SUB_IFDS]; ok {
+			for i := 0; i < int(t.Count); i++ {
+				v, err := t.Int64(i)
+				if err == nil {
+					queue = append(queue, v)
+				}
+			}
+		}
+		candidates := [][2]*tiff.Tag{{tags[TIFF_JPEG_OFFSET], tags[TIFF_JPEG_LENGTH]}}
+		if c, ok := tags[TIFF_COMPRESSION]; ok {
+			v, err := c.Int(0)
+			if err == nil && (v == 6 || v == 7) && tags[TIFF_STRIP_OFFSETS] != nil && tags[TIFF_STRIP_OFFSETS].Count == 1 {
+				candidates = append(candidates, [2]*tiff.Tag{tags[TIFF_STRIP_OFFSETS], tags[TIFF_STRIP_BYTE_COUNTS]})
+			}
+		}
+		for _, c := range candidates {
+			if c[0] == nil || c[1] == nil {
+				continue
+			}
+			start, err1 := c[0].Int64(0)
+			length, err2 := c[1].Int64(0)
+			if err1 != nil || err2 != nil || start <= 0 || length <= 0 || length > stat.Size()-start {
+				continue
+			}
+			cfg, err := jpeg.DecodeConfig(io.NewSectionReader(f, start, length))
+			if err != nil {
+				continue
+			}
+			if cfg.Width*cfg.Height > bestArea {
+				bestArea, bestOffset, bestLength = cfg.Width*cfg.Height, start, length
+			}
+		}
+	}
+	if bestArea == 0 {
+		return 0, 0, fmt.Errorf("raw file has no jpg preview")
+	}
+	return bestOffset, bestLength, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testTiffTag struct {
+	id    uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func testTiffLong(id uint16, v uint32) testTiffTag {
+	return testTiffTag{id: id, typ: 4, count: 1, value: binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func testTiffShort(id uint16, v uint16) testTiffTag {
+	return testTiffTag{id: id, typ: 3, count: 1, value: binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+//
+// Append data to a little endian TIFF file. Returns the file and the offset of the data.
+//
+func testTiffAppend(out, data []byte) ([]byte, uint32) {
+	if len(out)%2 != 0 {
+		out = append(out, 0)
+	}
+	return append(out, data...), uint32(len(out))
+}
+
+//
+// Append an IFD to a little endian TIFF file. Values longer than 4 bytes are written before the IFD.
+// Returns the file and the offset of the IFD.
+//
+func testTiffIFD(out []byte, tags []testTiffTag, next uint32) ([]byte, uint32) {
+	values := make([][]byte, len(tags))
+	for i, t := range tags {
+		v := append([]byte{}, t.value...)
+		if len(v) > 4 {
+			var offset uint32
+			out, offset = testTiffAppend(out, v)
+			v = binary.LittleEndian.AppendUint32(nil, offset)
+		}
+		values[i] = append(v, make([]byte, 4-len(v))...)
+	}
+	out, offset := testTiffAppend(out, binary.LittleEndian.AppendUint16(nil, uint16(len(tags))))
+	for i, t := range tags {
+		out = binary.LittleEndian.AppendUint16(out, t.id)
+		out = binary.LittleEndian.AppendUint16(out, t.typ)
+		out = binary.LittleEndian.AppendUint32(out, t.count)
+		out = append(out, values[i]...)
+	}
+	return binary.LittleEndian.AppendUint32(out, next), offset
+}
+
+func testRawJpeg(t *testing.T, w, h int, c color.RGBA) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var b bytes.Buffer
+	err := jpeg.Encode(&b, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+//
+// Write a RAW like TIFF file.
+//
+//    IFD0 has a small jpg thumbnail, orientation and an EXIF IFD with DateTimeOriginal.
+//    If cr2 is true the large jpg is an IFD0 strip with JPEG compression (as in CR2 files).
+//    Otherwise it is in a SubIFD along with lossless jpg 'raw data' that cannot be decoded (as in NEF and DNG files).
+//
+func writeTestRaw(t *testing.T, fileName string, cr2 bool) {
+	small := testRawJpeg(t, 16, 8, color.RGBA{R: 0, G: 0, B: 255, A: 255})
+	large := testRawJpeg(t, 64, 32, color.RGBA{R: 255, G: 0, B: 0, A: 255})
+	lossless := append([]byte{0xFF, 0xD8, 0xFF, 0xC3, 0x00, 0x0B, 0x08, 0x10, 0x00, 0x20, 0x00, 0x01, 0x01, 0x11, 0x00}, make([]byte, 4096)...)
+
+	out := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+	out, smallOffset := testTiffAppend(out, small)
+	out, largeOffset := testTiffAppend(out, large)
+	out, losslessOffset := testTiffAppend(out, lossless)
+	out, exifIFD := testTiffIFD(out, []testTiffTag{
+		{id: 0x9003, typ: 2, count: 20, value: []byte("2021:06:05 10:20:30\x00")},
+	}, 0)
+
+	tags := []testTiffTag{}
+	if cr2 {
+		tags = append(tags, testTiffShort(TIFF_COMPRESSION, 6), testTiffLong(TIFF_STRIP_OFFSETS, largeOffset))
+	}
+	tags = append(tags, testTiffShort(0x0112, 6))
+	if cr2 {
+		tags = append(tags, testTiffLong(TIFF_STRIP_BYTE_COUNTS, uint32(len(large))))
+	} else {
+		var sub1, sub2 uint32
+		out, sub1 = testTiffIFD(out, []testTiffTag{testTiffLong(TIFF_JPEG_OFFSET, largeOffset), testTiffLong(TIFF_JPEG_LENGTH, uint32(len(large)))}, 0)
+		out, sub2 = testTiffIFD(out, []testTiffTag{testTiffShort(TIFF_COMPRESSION, 7), testTiffLong(TIFF_STRIP_OFFSETS, losslessOffset), testTiffLong(TIFF_STRIP_BYTE_COUNTS, uint32(len(lossless)))}, 0)
+		tags = append(tags, testTiffTag{id: TIFF_SUB_IFDS, typ: 4, count: 2, value: binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, sub1), sub2)})
+	}
+	tags = append(tags, testTiffLong(0x8769, exifIFD))
+	// IFD1 has the small thumbnail
+	out, ifd1 := testTiffIFD(out, []testTiffTag{testTiffLong(TIFF_JPEG_OFFSET, smallOffset), testTiffLong(TIFF_JPEG_LENGTH, uint32(len(small)))}, 0)
+	out, ifd0 := testTiffIFD(out, tags, ifd1)
+	binary.LittleEndian.PutUint32(out[4:], ifd0)
+
+	err := os.WriteFile(fileName, out, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRawPreview(t *testing.T) {
+	dir := t.TempDir()
+	for i, cr2 := range []bool{false, true} {
+		fileName := filepath.Join(dir, "DSC_0001.NEF")
+		if cr2 {
+			fileName = filepath.Join(dir, "IMG_0001.CR2")
+		}
+		writeTestRaw(t, fileName, cr2)
+		f, err := openImage(fileName)
+		if err != nil {
+			t.Fatalf("Failed: id:%03d cr2:%t %s", i*4+1, cr2, err.Error())
+		}
+		cfg, err := jpeg.DecodeConfig(f)
+		f.Close()
+		if err != nil || cfg.Width != 64 || cfg.Height != 32 {
+			t.Fatalf("Failed: id:%03d cr2:%t the largest preview should be 64x32 not %dx%d", i*4+2, cr2, cfg.Width, cfg.Height)
+		}
+		// The preview location is cached so the TIFF structure is read once
+		if _, ok := RAW_PREVIEW_CACHE.entries[fileName]; !ok {
+			t.Fatalf("Failed: id:%03d cr2:%t the preview location should be cached", i*4+2, cr2)
+		}
+		pic := NewPicture(fileName, true)
+		if pic.orientation != 6 || pic.timeSource != "EXIF:DateTimeOriginal" || pic.time.Format("2006-01-02 15:04:05") != "2021-06-05 10:20:30" {
+			t.Fatalf("Failed: id:%03d cr2:%t orientation:%d time:%s source:%s", i*4+3, cr2, pic.orientation, pic.time, pic.timeSource)
+		}
+		opts := NewThumbOptions(10)
+		img, _, err := createThumbImage(pic, "t.jpg", opts, false, false, 0)
+		if err != nil {
+			t.Fatalf("Failed: id:%03d cr2:%t %s", i*4+4, cr2, err.Error())
+		}
+		if !near(img.RGBAAt(5, 5), 255, 0, 0) {
+			t.Fatalf("Failed: id:%03d cr2:%t colour:%v", i*4+4, cr2, img.RGBAAt(5, 5))
+		}
+	}
+}
+
+func TestRawNoPreview(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "empty.dng")
+	out, ifd0 := testTiffIFD([]byte{'I', 'I', 42, 0, 0, 0, 0, 0}, []testTiffTag{testTiffShort(0x0112, 1)}, 0)
+	binary.LittleEndian.PutUint32(out[4:], ifd0)
+	os.WriteFile(fileName, out, 0644)
+	_, err := openImage(fileName)
+	if err == nil {
+		t.Fatalf("Failed: id:001 a RAW file without a preview should fail")
+	}
+	fileName = filepath.Join(dir, "text.arw")
+	os.WriteFile(fileName, []byte("not a raw file"), 0644)
+	_, err = openImage(fileName)
+	if err == nil {
+		t.Fatalf("Failed: id:002 a file that is not TIFF should fail")
+	}
+	// The preview length is past the end of the file
+	fileName = filepath.Join(dir, "long.nef")
+	out, jpg := testTiffAppend([]byte{'I', 'I', 42, 0, 0, 0, 0, 0}, testRawJpeg(t, 16, 8, color.RGBA{R: 255, A: 255}))
+	out, ifd0 = testTiffIFD(out, []testTiffTag{testTiffLong(TIFF_JPEG_OFFSET, jpg), testTiffLong(TIFF_JPEG_LENGTH, 0xFFFFFFF0)}, 0)
+	binary.LittleEndian.PutUint32(out[4:], ifd0)
+	os.WriteFile(fileName, out, 0644)
+	_, err = openImage(fileName)
+	if err == nil {
+		t.Fatalf("Failed: id:006 a preview past the end of the file should be ignored")
+	}
+	if !isRawFile("a/b/IMG_1.Cr2") || isRawFile("a.jpg") {
+		t.Fatalf("Failed: id:003 isRawFile")
+	}
+	if _, ok := THUMB_FILE_TYPES[".nef"]; !ok {
+		t.Fatalf("Failed: id:004 RAW files should be thumbnail file types")
+	}
+	pic := NewPicture(fileName, true)
+	opts := NewThumbOptions(200)
+	opts.noUpscale = true
+	opts.small = SMALL_PASSTHROUGH
+	if canPassthrough(pic, opts) {
+		t.Fatalf("Failed: id:005 RAW files should never be passed through")
+	}
+}
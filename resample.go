@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+const (
+	FILTER_NEAREST    = "nearest"
+	FILTER_BILINEAR   = "bilinear"
+	FILTER_CATMULLROM = "catmullrom"
+	FILTER_LANCZOS    = "lanczos"
+)
+
+//
+// A resampling filter. The kernel is zero outside -support..support.
+// A nil kernel uses the nearest source pixel only.
+//
+type ResampleFilter struct {
+	support float64
+	kernel  func(float64) float64
+}
+
+var (
+	RESAMPLE_FILTERS = map[string]*ResampleFilter{
+		FILTER_NEAREST: {support: 0, kernel: nil},
+		FILTER_BILINEAR: {support: 1, kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			if x < 1 {
+				return 1 - x
+			}
+			return 0
+		}},
+		FILTER_CATMULLROM: {support: 2, kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			if x < 1 {
+				return (1.5*x-2.5)*x*x + 1
+			}
+			if x < 2 {
+				return ((-0.5*x+2.5)*x-4)*x + 2
+			}
+			return 0
+		}},
+		FILTER_LANCZOS: {support: 3, kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			if x < 1e-9 {
+				return 1
+			}
+			if x < 3 {
+				px := math.Pi * x
+				return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+			}
+			return 0
+		}},
+	}
+)
+
+func validFilter(filter string) (string, error) {
+	f := strings.ToLower(strings.TrimSpace(filter))
+	_, ok := RESAMPLE_FILTERS[f]
+	if ok {
+		return f, nil
+	}
+	return "", fmt.Errorf("filter=%s is invalid. Use %s, %s, %s or %s", filter, FILTER_NEAREST, FILTER_BILINEAR, FILTER_CATMULLROM, FILTER_LANCZOS)
+}
+
+//
+// The source pixels and their weights that make up one destination pixel.
+//
+type resampleWeights struct {
+	start   int
+	weights []float32
+}
+
+//
+// Calculate the weights for each destination pixel along one axis.
+// When scaling down the kernel is stretched so every source pixel contributes (no aliasing).
+//
+func makeResampleWeights(dstLen, srcLen int, filter *ResampleFilter) []resampleWeights {
+	scale := float64(srcLen) / float64(dstLen)
+	stretch := math.Max(scale, 1)
+	support := filter.support * stretch
+	contribs := make([]resampleWeights, dstLen)
+	for i := 0; i < dstLen; i++ {
+		centre := (float64(i)+0.5)*scale - 0.5
+		if filter.kernel == nil {
+			contribs[i] = resampleWeights{start: minInt(maxInt(int((float64(i)+0.5)*scale), 0), srcLen-1), weights: []float32{1}}
+			continue
+		}
+		start := int(math.Ceil(centre - support))
+		end := int(math.Floor(centre + support))
+		if start < 0 {
+			start = 0
+		}
+		if end > srcLen-1 {
+			end = srcLen - 1
+		}
+		weights := make([]float32, end-start+1)
+		sum := 0.0
+		for j := start; j <= end; j++ {
+			w := filter.kernel((float64(j) - centre) / stretch)
+			weights[j-start] = float32(w)
+			sum += w
+		}
+		if sum == 0 {
+			weights = []float32{1}
+			start = minInt(maxInt(int(math.Round(centre)), 0), srcLen-1)
+		} else {
+			for j := range weights {
+				weights[j] = float32(float64(weights[j]) / sum)
+			}
+		}
+		contribs[i] = resampleWeights{start: start, weights: weights}
+	}
+	return contribs
+}
+
+//
+// Return a function that reads row y (0 is the top of the bounds) of the image as RGBA (alpha pre-multiplied).
+// Rows of an *image.RGBA are not copied. Other images are converted one row at a time into a buffer
+// so a full size copy of the source is never made. The row is only valid until the next call.
+//
+func rgbaRowReader(src image.Image) func(y int) []uint8 {
+	b := src.Bounds()
+	if rgba, ok := src.(*image.RGBA); ok {
+		return func(y int) []uint8 {
+			return rgba.Pix[rgba.PixOffset(b.Min.X, b.Min.Y+y):]
+		}
+	}
+	buf := image.NewRGBA(image.Rect(0, 0, b.Dx(), 1))
+	return func(y int) []uint8 {
+		draw.Draw(buf, buf.Bounds(), src, image.Pt(b.Min.X, b.Min.Y+y), draw.Src)
+		return buf.Pix
+	}
+}
+
+//
+// Scale the image to w x h using the named filter.
+// The filter is applied horizontally then vertically (separable).
+// The horizontal pass reads the source a row at a time so only the (smaller) intermediate image is held.
+//
+func resample(src image.Image, w, h int, filterName string) *image.RGBA {
+	filter, ok := RESAMPLE_FILTERS[filterName]
+	if !ok {
+		filter = RESAMPLE_FILTERS[FILTER_CATMULLROM]
+	}
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if sw == 0 || sh == 0 || w == 0 || h == 0 {
+		return dst
+	}
+
+	//
+	// Horizontal pass. sh rows of w pixels
+	//
+	xWeights := makeResampleWeights(w, sw, filter)
+	tmp := make([]float32, w*sh*4)
+	readRow := rgbaRowReader(src)
+	for y := 0; y < sh; y++ {
+		row := readRow(y)
+		out := tmp[y*w*4:]
+		for x, c := range xWeights {
+			var r, g, b, a float32
+			p := c.start * 4
+			for _, wt := range c.weights {
+				r += float32(row[p]) * wt
+				g += float32(row[p+1]) * wt
+				b += float32(row[p+2]) * wt
+				a += float32(row[p+3]) * wt
+				p += 4
+			}
+			out[x*4] = r
+			out[x*4+1] = g
+			out[x*4+2] = b
+			out[x*4+3] = a
+		}
+	}
+
+	//
+	// Vertical pass. h rows of w pixels
+	//
+	yWeights := makeResampleWeights(h, sh, filter)
+	for y, c := range yWeights {
+		out := dst.Pix[dst.PixOffset(0, y):]
+		for x := 0; x < w*4; x += 4 {
+			var r, g, b, a float32
+			p := c.start*w*4 + x
+			for _, wt := range c.weights {
+				r += tmp[p] * wt
+				g += tmp[p+1] * wt
+				b += tmp[p+2] * wt
+				a += tmp[p+3] * wt
+				p += w * 4
+			}
+			alpha := clampByte(a)
+			out[x] = minByte(clampByte(r), alpha)
+			out[x+1] = minByte(clampByte(g), alpha)
+			out[x+2] = minByte(clampByte(b), alpha)
+			out[x+3] = alpha
+		}
+	}
+	return dst
+}
+
+//
+// Sharpen the image. amount is the strength. 0 is no change, 1 is a strong effect.
+// The image is blurred (3x3) and the difference from the original is added back.
+//
+func unsharpMask(img *image.RGBA, amount float64) *image.RGBA {
+	if amount <= 0 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := toRGBA(img)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	at := func(x, y, ch int) float32 {
+		x = minInt(maxInt(x, 0), w-1)
+		y = minInt(maxInt(y, 0), h-1)
+		return float32(src.Pix[y*src.Stride+x*4+ch])
+	}
+	amt := float32(amount)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*dst.Stride + x*4
+			alpha := src.Pix[y*src.Stride+x*4+3]
+			for ch := 0; ch < 3; ch++ {
+				blur := (4*at(x, y, ch) +
+					2*(at(x-1, y, ch)+at(x+1, y, ch)+at(x, y-1, ch)+at(x, y+1, ch)) +
+					at(x-1, y-1, ch) + at(x+1, y-1, ch) + at(x-1, y+1, ch) + at(x+1, y+1, ch)) / 16
+				v := at(x, y, ch)
+				dst.Pix[i+ch] = minByte(clampByte(v+amt*(v-blur)), alpha)
+			}
+			dst.Pix[i+3] = alpha
+		}
+	}
+	return dst
+}
+
+func clampByte(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+func minByte(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestResample(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for i := range flat.Pix {
+		flat.Pix[i] = 200
+	}
+	for _, f := range []string{FILTER_NEAREST, FILTER_BILINEAR, FILTER_CATMULLROM, FILTER_LANCZOS} {
+		assertFlat(t, "001:"+f, resample(flat, 13, 7, f), 200)
+		assertFlat(t, "002:"+f, resample(flat, 80, 60, f), 200)
+	}
+	//
+	// Scaling 0..5 by half. Bilinear blends neighbours (edges are clamped), nearest picks one of each pair
+	//
+	img := testImage(6, 1)
+	assertPix(t, "003", resample(img, 3, 1, FILTER_BILINEAR), 3, 1, []uint8{1, 3, 4})
+	assertPix(t, "004", resample(img, 3, 1, FILTER_NEAREST), 3, 1, []uint8{1, 3, 5})
+	assertPix(t, "005", resample(img, 6, 1, FILTER_LANCZOS), 6, 1, []uint8{0, 1, 2, 3, 4, 5})
+
+	//
+	// Images that are not RGBA (and sub images) are read a row at a time. The result is the same as an RGBA copy
+	//
+	ycc := image.NewYCbCr(image.Rect(0, 0, 40, 30), image.YCbCrSubsampleRatio420)
+	grey := image.NewGray(image.Rect(0, 0, 40, 30))
+	cmyk := image.NewCMYK(image.Rect(0, 0, 40, 30))
+	for i := range ycc.Y {
+		ycc.Y[i] = uint8(i * 7)
+		grey.Pix[i] = uint8(i * 3)
+	}
+	for i := range ycc.Cb {
+		ycc.Cb[i] = uint8(i * 5)
+		ycc.Cr[i] = uint8(255 - i*5)
+	}
+	for i := range cmyk.Pix {
+		cmyk.Pix[i] = uint8(i * 11)
+	}
+	for i, src := range []image.Image{ycc, grey, cmyk, ycc.SubImage(image.Rect(5, 3, 33, 29)), testImage(40, 30).SubImage(image.Rect(1, 1, 39, 29))} {
+		expected := resample(toRGBA(src), 13, 9, FILTER_CATMULLROM)
+		actual := resample(src, 13, 9, FILTER_CATMULLROM)
+		for j := range expected.Pix {
+			if expected.Pix[j] != actual.Pix[j] {
+				t.Fatalf("Failed: id:%03d pixel %d expected:%d actual:%d", i+6, j/4, expected.Pix[j], actual.Pix[j])
+			}
+		}
+	}
+}
+
+func TestUnsharpMask(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 5, 5))
+	for i := range flat.Pix {
+		flat.Pix[i] = 100
+	}
+	assertFlat(t, "001", unsharpMask(flat, 1), 100)
+	//
+	// A bright pixel gets brighter, its neighbours darker
+	//
+	flat.SetRGBA(2, 2, color.RGBA{R: 150, G: 150, B: 150, A: 255})
+	s := unsharpMask(flat, 1)
+	if s.RGBAAt(2, 2).R <= 150 || s.RGBAAt(1, 2).R >= 100 {
+		t.Fatalf("Failed: id:002 centre:%d neighbour:%d", s.RGBAAt(2, 2).R, s.RGBAAt(1, 2).R)
+	}
+	if unsharpMask(flat, 0) != flat {
+		t.Fatalf("Failed: id:003 sharpen=0 should return the same image")
+	}
+}
+
+func assertFlat(t *testing.T, id string, img *image.RGBA, expected uint8) {
+	for i, p := range img.Pix {
+		if i%4 != 3 && p != expected {
+			t.Fatalf("Failed: id:%s pixel %d expected:%d actual:%d", id, i/4, expected, p)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"image/color"
 	"image/jpeg"
+	"image/png"
 	"io/fs"
 	"io/ioutil"
 	"log"
@@ -11,6 +14,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,24 +24,38 @@ import (
 
 type UserData struct {
 	userName  string
-	locations map[string]string
+	locations map[string]*Location
+}
+
+//
+// A user location. path is relative to the server source path.
+// background overrides the server background colour for thumbnails. nil if not defined.
+// watermark is the location watermark, or the user watermark if the location does not define one. nil if neither do.
+//
+type Location struct {
+	path       string
+	background *color.RGBA
+	watermark  *Watermark
 }
 
 type TNServer struct {
-	port          int
-	server        *http.Server
-	thumbNailSize int
-	getRoutes     map[string]func([]string, *TNServer, http.ResponseWriter, *http.Request) *TNResp
-	srcPath       string
-	verbose       bool
-	startTime     int64
-	users         map[string]*UserData
+	port         int
+	server       *http.Server
+	thumbOptions *ThumbOptions
+	getRoutes    map[string]func([]string, *TNServer, http.ResponseWriter, *http.Request) *TNResp
+	srcPath      string
+	verbose      bool
+	startTime    int64
+	users        map[string]*UserData
+	metaCache    *MetaCache
+	groupGaps    *GroupGaps
 }
 
 type TNResp struct {
 	returnCode int
 	mimeType   string
 	resp       []byte
+	headers    map[string]string
 }
 
 const (
@@ -54,6 +72,7 @@ var (
 		".jpg":  "image/jpeg",
 		".jpeg": "image/jpeg",
 		".png":  "image/png",
+		".gif":  "image/gif",
 	}
 
 	THUMB_FILE_TYPE = ".jpg"
@@ -80,6 +99,16 @@ func BR(tag, ent string, uri []string, err error) *TNResp {
 	return &TNResp{returnCode: http.StatusBadRequest, mimeType: MEDIA_JSON, resp: []byte(fmt.Sprintf("{\"message\":\"Bad Request\", \"Value\": \"%s\"\"}", ent))}
 }
 
+func PTL(tag, ent string, uri []string, err error) *TNResp {
+	logServer(fmt.Sprintf("PayloadTooLarge:%s: ent:%s", tag, ent), strings.Join(uri, URL_SEP), err)
+	return &TNResp{returnCode: http.StatusRequestEntityTooLarge, mimeType: MEDIA_JSON, resp: []byte(fmt.Sprintf("{\"message\":\"Payload Too Large\", \"Item\": \"%s\", \"Reason\": %s}", ent, jsonQuote(err.Error())))}
+}
+
+func UPE(tag, ent string, uri []string, err error) *TNResp {
+	logServer(fmt.Sprintf("UnprocessableEntity:%s: ent:%s", tag, ent), strings.Join(uri, URL_SEP), err)
+	return &TNResp{returnCode: http.StatusUnprocessableEntity, mimeType: MEDIA_JSON, resp: []byte(fmt.Sprintf("{\"message\":\"Unprocessable Entity\", \"Item\": \"%s\", \"Reason\": %s}", ent, jsonQuote(err.Error())))}
+}
+
 func (s *TNResp) String() string {
 	return fmt.Sprintf("{\"RESPONSE\":{\"rc\":\"%d\",\"mime\":\"%s\",\"len\":\"%d\",\"resp\":\"%s\" }}", s.returnCode, s.mimeType, len(s.resp), EncodeString(s.resp, 50, s.mimeType))
 }
@@ -144,25 +173,37 @@ func EncodeString(b []byte, max int, mt string) string {
 	return sb.String()
 }
 
-func NewTnServer(port int, srcPath, configPath string, sizeInt int, verbose bool) (*TNServer, error) {
+func readConfigData(configPath string, verbose bool) (parser.NodeC, string, error) {
 	absFileName, err := filepath.Abs(configPath)
 	if err != nil {
-		return nil, err
+		return nil, configPath, err
 	}
 	j, err := ioutil.ReadFile(absFileName)
 	if err != nil {
-		return nil, err
+		return nil, absFileName, err
 	}
 	if strings.TrimSpace(string(j)) == "" {
-		return nil, fmt.Errorf("file '%s' is empty", absFileName)
+		return nil, absFileName, fmt.Errorf("file '%s' is empty", absFileName)
 	}
 	configData, err := parser.Parse(j)
 	if err != nil {
-		return nil, err
+		return nil, absFileName, err
 	}
 	if verbose {
 		log.Printf("{\"CONFIG\":{\"file\":\"%s\",\"info\":\"Parsed config ok\"}}", absFileName)
 	}
+	err = loadNameTimeRules(configData)
+	if err != nil {
+		return nil, absFileName, err
+	}
+	return configData, absFileName, nil
+}
+
+func NewTnServer(port int, srcPath, configPath string, thumbOptions *ThumbOptions, verbose bool) (*TNServer, error) {
+	configData, absFileName, err := readConfigData(configPath, verbose)
+	if err != nil {
+		return nil, err
+	}
 	userDataNode, err := parser.Find(configData, USER_PATH)
 	if err != nil {
 		return nil, err
@@ -171,6 +212,21 @@ func NewTnServer(port int, srcPath, configPath string, sizeInt int, verbose bool
 	if !ok {
 		return nil, fmt.Errorf("config data [%s] node %s is not a json object", absFileName, USER_PATH.String())
 	}
+	if thumbOptions.watermark == nil {
+		thumbOptions.watermark, err = watermarkFromConfigData(configData, absFileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	metaCacheSize, err := findIntArg(META_CACHE_ARG, 0, 10000000, 10000)
+	if err != nil {
+		return nil, err
+	}
+	groupGaps, err := NewGroupGapsFromArgs()
+	if err != nil {
+		return nil, err
+	}
+	configDir := filepath.Dir(absFileName)
 	userMap := make(map[string]*UserData)
 	for _, ud := range userDataObj.GetValues() {
 		name := ud.GetName()
@@ -178,11 +234,31 @@ func NewTnServer(port int, srcPath, configPath string, sizeInt int, verbose bool
 		if !ok {
 			return nil, fmt.Errorf("user data node %s.%s is not an object node", USER_PATH, name)
 		}
-		locations := make(map[string]string)
+		var userWatermark *Watermark
+		wmObj, ok := udObj.GetNodeWithName(WATERMARK_NAME).(*parser.JsonObject)
+		if ok {
+			userWatermark, err = NewWatermarkFromConfig(wmObj, configDir)
+			if err != nil {
+				return nil, fmt.Errorf("user data node %s.%s.%s %s", USER_PATH, name, WATERMARK_NAME, err.Error())
+			}
+		}
+		locations := make(map[string]*Location)
 		for _, udv := range udObj.GetValues() {
-			udvStr, ok := udv.(*parser.JsonString)
-			if ok {
-				locations[udvStr.GetName()] = udvStr.GetValue()
+			if udv.GetName() == WATERMARK_NAME {
+				continue
+			}
+			switch v := udv.(type) {
+			case *parser.JsonString:
+				locations[v.GetName()] = &Location{path: v.GetValue(), watermark: userWatermark}
+			case *parser.JsonObject:
+				loc, err := newLocation(v, configDir)
+				if err != nil {
+					return nil, fmt.Errorf("user data node %s.%s.%s %s", USER_PATH, name, v.GetName(), err.Error())
+				}
+				if loc.watermark == nil {
+					loc.watermark = userWatermark
+				}
+				locations[v.GetName()] = loc
 			}
 		}
 		userMap[ud.GetName()] = &UserData{userName: name, locations: locations}
@@ -197,7 +273,7 @@ func NewTnServer(port int, srcPath, configPath string, sizeInt int, verbose bool
 	}
 
 	routes := make(map[string]func([]string, *TNServer, http.ResponseWriter, *http.Request) *TNResp)
-	tns := &TNServer{port: port, srcPath: srcPath, getRoutes: routes, thumbNailSize: sizeInt, verbose: verbose, users: userMap, startTime: time.Now().Unix()}
+	tns := &TNServer{port: port, srcPath: srcPath, getRoutes: routes, thumbOptions: thumbOptions, verbose: verbose, users: userMap, startTime: time.Now().Unix(), metaCache: NewMetaCache(metaCacheSize), groupGaps: groupGaps}
 	srv := &http.Server{
 		Addr: fmt.Sprintf(":%d", port),
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -230,6 +306,10 @@ func NewTnServer(port int, srcPath, configPath string, sizeInt int, verbose bool
 	tns.AddGetHandler("control", controlHandler)
 	tns.AddGetHandler("files", fileHandler)
 	tns.AddGetHandler("paths", pathHandler)
+	tns.AddGetHandler("meta", metaHandler)
+	tns.AddGetHandler("placeholder", placeholderHandler)
+	tns.AddGetHandler("quality", qualityHandler)
+	tns.AddGetHandler("groups", groupsHandler)
 	tns.server = srv
 	if verbose {
 		log.Printf("{\"SERVER\":{\"port\":\"%d\",\"info\":\"Configured\"}}", port)
@@ -237,6 +317,43 @@ func NewTnServer(port int, srcPath, configPath string, sizeInt int, verbose bool
 	return tns, nil
 }
 
+//
+// A location defined as an object:
+//
+//    "dir1": {"path": "files1", "background": "black", "watermark": {"text": "(C) Me"}}
+//
+func newLocation(obj *parser.JsonObject, configDir string) (*Location, error) {
+	loc := &Location{path: configString(obj, "path", "")}
+	bg := configString(obj, "background", "")
+	if bg != "" {
+		c, err := validColour("background=", bg)
+		if err != nil {
+			return nil, err
+		}
+		loc.background = &c
+	}
+	wmObj, ok := obj.GetNodeWithName(WATERMARK_NAME).(*parser.JsonObject)
+	if ok {
+		wm, err := NewWatermarkFromConfig(wmObj, configDir)
+		if err != nil {
+			return nil, err
+		}
+		loc.watermark = wm
+	}
+	return loc, nil
+}
+
+//
+// The location config for /user/{user}/loc/{loc}. nil if not found.
+//
+func locationConfig(uri []string, tns *TNServer) *Location {
+	ud, ok := tns.users[dataFromPathElement(uri, "user")]
+	if !ok {
+		return nil
+	}
+	return ud.locations[dataFromPathElement(uri, "loc")]
+}
+
 //
 // /paths/user/{user}/loc/{loc} to filepath
 //
@@ -249,7 +366,11 @@ func locationFromPath(uri []string, tns *TNServer) (string, *TNResp) {
 	if loc == "" {
 		return "", NF("PATH", uri, nil)
 	}
-	location := filepath.Join(tns.srcPath, tns.users[user].locations[loc])
+	locData := locationConfig(uri, tns)
+	if locData == nil {
+		return "", NF("PATH", uri, nil)
+	}
+	location := filepath.Join(tns.srcPath, locData.path)
 	_, err := os.Stat(location)
 	if err != nil {
 		return "", ISE("PATH", location, uri, err)
@@ -353,16 +474,37 @@ func fileHandler(uri []string, tns *TNServer, w http.ResponseWriter, r *http.Req
 		return resp
 	}
 
+	thumbOptions, err := tns.thumbOptions.WithLocation(locationConfig(uri, tns)).WithQuery(r.URL.Query())
+	if err != nil {
+		return BR("THUMB", err.Error(), uri, err)
+	}
+
 	if isDir {
-		return returnFileList(path, queryAllFile(r))
+		if queryDetail(r) {
+			palette, err := queryPalette(r)
+			if err != nil {
+				return BR("FILE", err.Error(), uri, err)
+			}
+			return returnFileDetailList(path, queryAllFile(r), querySortByTime(r), queryKeyword(r), queryPlaceholder(r), palette, thumbOptions, tns.metaCache)
+		}
+		return returnFileList(path, queryAllFile(r), querySortByTime(r), queryKeyword(r))
 	}
 
-	thumbnail, thumbNailSize := queryThumbnail(r, tns.thumbNailSize)
-	return returnFileContent(path, uri, thumbnail, thumbNailSize, tns)
+	if !queryThumbnail(r) {
+		return returnFileContent(path, uri, false, thumbOptions, tns)
+	}
+	return returnFileContent(path, uri, true, thumbOptions, tns)
 }
 
-func returnFileList(path string, all bool) *TNResp {
-	list := filesOfInterest(path, all)
+//
+// A json list of file names. If keyword is not "" only images with the keyword (IPTC or XMP) are listed.
+//
+func returnFileList(path string, all bool, byTime bool, keyword string) *TNResp {
+	pics := NewListPictures(path)
+	list := filterByKeyword(pics, filesOfInterest(path, all), keyword)
+	if byTime {
+		sortFilesByTime(pics, list)
+	}
 
 	var sb strings.Builder
 	count := 0
@@ -378,8 +520,42 @@ func returnFileList(path string, all bool) *TNResp {
 	return &TNResp{returnCode: http.StatusOK, mimeType: MEDIA_JSON, resp: []byte(s + "\n]")}
 }
 
-func returnFileContent(srcFile string, uri []string, thumbnail bool, thumbNailSize int, tns *TNServer) *TNResp {
-	ext := filepath.Ext(srcFile)
+//
+// A json list of objects. Images include the meta data (see pictureMeta). Other files only have a name.
+// Images can also include the BlurHash of the thumbnail and the colour palette (see addDecodedMeta).
+// If keyword is not "" only images with the keyword (IPTC or XMP) are listed.
+//
+func returnFileDetailList(path string, all bool, byTime bool, keyword string, placeholder bool, palette int, thumbOptions *ThumbOptions, cache *MetaCache) *TNResp {
+	pics := NewListPictures(path)
+	list := filterByKeyword(pics, filesOfInterest(path, all), keyword)
+	if byTime {
+		sortFilesByTime(pics, list)
+	}
+
+	var sb strings.Builder
+	count := 0
+	sb.WriteString("[")
+	for _, f := range list {
+		var jf *JsonFields
+		_, ok := THUMB_FILE_TYPES[strings.ToLower(filepath.Ext(f))]
+		if ok || isVideoFile(f) {
+			pic := pics.get(f)
+			jf = addDecodedMeta(pictureMeta(pic, thumbOptions), pic, thumbOptions, cache, palette, placeholder)
+		} else {
+			jf = NewJsonFields().Add("name", f)
+		}
+		sb.WriteString(fmt.Sprintf("\n  %s,", jf.String()))
+		count++
+	}
+	s := sb.String()
+	if count > 0 {
+		s = s[:len(s)-1]
+	}
+	return &TNResp{returnCode: http.StatusOK, mimeType: MEDIA_JSON, resp: []byte(s + "\n]")}
+}
+
+func returnFileContent(srcFile string, uri []string, thumbnail bool, thumbOptions *ThumbOptions, tns *TNServer) *TNResp {
+	ext := strings.ToLower(filepath.Ext(srcFile))
 	_, fName := filepath.Split(srcFile)
 
 	if thumbnail {
@@ -389,18 +565,63 @@ func returnFileContent(srcFile string, uri []string, thumbnail bool, thumbNailSi
 		}
 		pic := NewPicture(srcFile, thumbnail)
 		if pic.err != nil {
-			return NF("IMAGE", uri, pic.err)
+			if os.IsNotExist(pic.err) {
+				return NF("IMAGE", uri, pic.err)
+			}
+			if tns.verbose {
+				// Images without EXIF data (png, gif) can still be thumbnailed
+				logServer("EXIF", pic.GetFileName(), pic.err)
+			}
 		}
-		dstImage, err := createThumbImage(pic, "", thumbNailSize, tns.verbose, true, len(tns.srcPath))
+		if canPassthrough(pic, thumbOptions) {
+			buf, err := ioutil.ReadFile(srcFile)
+			if err != nil {
+				return ISE("FILE", fName, uri, err)
+			}
+			return &TNResp{returnCode: http.StatusOK, mimeType: THUMB_FILE_TYPES[ext], resp: buf, headers: map[string]string{"X-Thumb-Source": "original"}}
+		}
+		if thumbOptions.animate && pic.ext == THUMB_ANIM_TYPE {
+			data, info, err := createAnimatedThumb(pic, "", thumbOptions, tns.verbose)
+			if err != nil {
+				return thumbErrorResp(pic, uri, err)
+			}
+			if data != nil {
+				headers := map[string]string{"X-Thumb-Frames": fmt.Sprintf("%d", info.frames)}
+				if info.CropString() != "" {
+					headers["X-Thumb-Crop"] = info.CropString()
+				}
+				return &TNResp{returnCode: http.StatusOK, mimeType: THUMB_FILE_TYPES[THUMB_ANIM_TYPE], resp: data, headers: headers}
+			}
+		}
+		dstImage, info, err := createThumbImage(pic, "", thumbOptions, tns.verbose, true, len(tns.srcPath))
 		if err != nil {
-			return ISE("THUMB", pic.GetFileName(), uri, err)
+			return thumbErrorResp(pic, uri, err)
 		}
 		w := NewEncodedWriter(500)
-		err = jpeg.Encode(w, dstImage, &jpeg.Options{Quality: jpeg.DefaultQuality})
+		err = jpeg.Encode(w, outputImage(dstImage, info, thumbOptions), &jpeg.Options{Quality: jpeg.DefaultQuality})
 		if err != nil {
 			return ISE("ENCODE", pic.GetFileName(), uri, err)
 		}
-		return &TNResp{returnCode: http.StatusOK, mimeType: THUMB_FILE_TYPES[THUMB_FILE_TYPE], resp: w.Bytes()}
+		headers := make(map[string]string)
+		if info.CropString() != "" {
+			headers["X-Thumb-Crop"] = info.CropString()
+		}
+		if info.iccWarning != "" {
+			headers["X-Thumb-ICC-Warning"] = info.iccWarning
+		}
+		if info.preview {
+			headers["X-Thumb-Source"] = "preview"
+		} else {
+			headers["X-Thumb-Source"] = "image"
+		}
+		return &TNResp{returnCode: http.StatusOK, mimeType: THUMB_FILE_TYPES[THUMB_FILE_TYPE], resp: w.Bytes(), headers: headers}
+	}
+
+	if thumbOptions != nil && thumbOptions.watermark != nil && thumbOptions.watermark.full {
+		_, ok := THUMB_FILE_TYPES[ext]
+		if ok {
+			return returnWatermarkedImage(srcFile, uri, thumbOptions)
+		}
 	}
 
 	mediaType := mime.TypeByExtension(ext)
@@ -411,6 +632,55 @@ func returnFileContent(srcFile string, uri []string, thumbnail bool, thumbNailSi
 	return &TNResp{returnCode: http.StatusOK, mimeType: mediaType, resp: buf}
 }
 
+//
+// A full size image with the watermark. The image is rotated upright as the EXIF data is not kept.
+// png files are returned as png. Other images are returned as jpg.
+//
+func returnWatermarkedImage(srcFile string, uri []string, thumbOptions *ThumbOptions) *TNResp {
+	pic := NewPicture(srcFile, true)
+	// The decoded image, the RGBA copy and the rotated copy are all full size
+	copies := int64(2)
+	if pic.orientation != 1 {
+		copies = 3
+	}
+	img, reserved, err := thumbOptions.limits.decode(srcFile, copies)
+	if err != nil {
+		return thumbErrorResp(pic, uri, err)
+	}
+	defer thumbOptions.limits.budget.release(reserved)
+	dstImage := orientImage(toRGBA(img), pic.orientation, srcFile)
+	if thumbOptions.icc {
+		dstImage = iccToSRGB(srcFile, dstImage, &ThumbInfo{})
+	}
+	w := NewEncodedWriter(5000)
+	mimeType := THUMB_FILE_TYPES[".png"]
+	if pic.ext == ".png" {
+		err = png.Encode(w, thumbOptions.watermark.apply(dstImage))
+	} else {
+		mimeType = THUMB_FILE_TYPES[THUMB_FILE_TYPE]
+		err = jpeg.Encode(w, thumbOptions.watermark.apply(flattenAlpha(dstImage, thumbOptions.background)), &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return ISE("ENCODE", pic.GetFileName(), uri, err)
+	}
+	return &TNResp{returnCode: http.StatusOK, mimeType: mimeType, resp: w.Bytes()}
+}
+
+//
+// The response for an error creating a thumbnail.
+// Images that break the decode limits return 413 or 422.
+//
+func thumbErrorResp(pic *Picture, uri []string, err error) *TNResp {
+	var limitErr *ImageLimitError
+	if errors.As(err, &limitErr) {
+		if limitErr.status == http.StatusRequestEntityTooLarge {
+			return PTL("THUMB", pic.GetFileName(), uri, err)
+		}
+		return UPE("THUMB", pic.GetFileName(), uri, err)
+	}
+	return ISE("THUMB", pic.GetFileName(), uri, err)
+}
+
 func controlHandler(uri []string, tns *TNServer, w http.ResponseWriter, r *http.Request) *TNResp {
 	if uri[0] == "close" {
 		go func() {
@@ -432,9 +702,12 @@ func writeResp(tns *TNServer, w http.ResponseWriter, resp *TNResp) {
 	if tns.verbose {
 		log.Print(resp)
 	}
-	w.WriteHeader(resp.returnCode)
 	w.Header().Set("Content-Type", resp.mimeType)
 	w.Header().Add("Content-Length", fmt.Sprintf("%d", len(resp.resp)))
+	for n, v := range resp.headers {
+		w.Header().Set(n, v)
+	}
+	w.WriteHeader(resp.returnCode)
 	_, _ = w.Write(resp.resp)
 }
 
@@ -456,17 +729,10 @@ func (s *TNServer) Run() error {
 	return s.server.ListenAndServe()
 }
 
-func queryThumbnail(r *http.Request, defSize int) (bool, int) {
+func queryThumbnail(r *http.Request) bool {
 	tnRaw := r.URL.Query().Get("thumbnail")
 	tn := strings.TrimSpace(tnRaw)
-	if tn == "" {
-		return false, 0
-	}
-	i, err := strconv.Atoi(tn)
-	if err != nil {
-		return true, defSize
-	}
-	return true, i
+	return tn != ""
 }
 
 func queryAllFile(r *http.Request) bool {
@@ -475,6 +741,24 @@ func queryAllFile(r *http.Request) bool {
 	return tn != ""
 }
 
+func queryDetail(r *http.Request) bool {
+	tnRaw := r.URL.Query().Get("detail")
+	tn := strings.TrimSpace(tnRaw)
+	return tn == "true"
+}
+
+func queryPlaceholder(r *http.Request) bool {
+	tnRaw := r.URL.Query().Get("placeholder")
+	tn := strings.TrimSpace(tnRaw)
+	return tn == "true"
+}
+
+func querySortByTime(r *http.Request) bool {
+	tnRaw := r.URL.Query().Get("sort")
+	tn := strings.TrimSpace(tnRaw)
+	return tn == "time"
+}
+
 func dataFromPathElement(uri []string, name string) string {
 	for i, s := range uri {
 		if s == name && len(uri) > i+1 {
@@ -494,7 +778,7 @@ func filesOfInterest(path string, all bool) []string {
 		if !strings.HasPrefix(f.Name(), ".") {
 			if !f.IsDir() {
 				mt := mime.TypeByExtension(strings.ToLower(filepath.Ext(f.Name())))
-				if all || strings.HasPrefix(mt, "image/") {
+				if all || strings.HasPrefix(mt, "image/") || strings.HasPrefix(mt, "video/") {
 					list = append(list, f.Name())
 				}
 			}
@@ -502,3 +786,40 @@ func filesOfInterest(path string, all bool) []string {
 	}
 	return list
 }
+
+//
+// The pictures in a directory listing. Reading a picture (EXIF, XMP and IPTC) is slow so each is read
+// once and used for the keyword filter, the sort and the detail output.
+//
+type ListPictures struct {
+	path string
+	pics map[string]*Picture
+}
+
+func NewListPictures(path string) *ListPictures {
+	return &ListPictures{path: path, pics: make(map[string]*Picture)}
+}
+
+func (lp *ListPictures) get(name string) *Picture {
+	pic, ok := lp.pics[name]
+	if !ok {
+		pic = NewPicture(filepath.Join(lp.path, name), true)
+		lp.pics[name] = pic
+	}
+	return pic
+}
+
+//
+// Sort the file names using the full precision (sub second) picture time.
+// Files with the same time are sorted by name.
+//
+func sortFilesByTime(pics *ListPictures, list []string) {
+	sort.SliceStable(list, func(i, j int) bool {
+		ti := pics.get(list[i]).time
+		tj := pics.get(list[j]).time
+		if ti.Equal(tj) {
+			return list[i] < list[j]
+		}
+		return ti.Before(tj)
+	})
+}
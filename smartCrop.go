@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const (
+	CROP_CENTRE     = "centre"
+	CROP_EDGES      = "edges"
+	CROP_ENTROPY    = "entropy"
+	CROP_SATURATION = "saturation"
+
+	SMART_CROP_SIZE = 96 // The long side of the copy used to choose the crop
+)
+
+func validCrop(crop string) (string, error) {
+	c := strings.ToLower(strings.TrimSpace(crop))
+	switch c {
+	case "center":
+		return CROP_CENTRE, nil
+	case CROP_CENTRE, CROP_EDGES, CROP_ENTROPY, CROP_SATURATION:
+		return c, nil
+	}
+	return "", fmt.Errorf("crop=%s is invalid. Use %s, %s, %s or %s", crop, CROP_CENTRE, CROP_EDGES, CROP_ENTROPY, CROP_SATURATION)
+}
+
+//
+// Choose the position of a cw x ch crop window in the upright image using the strategy.
+// img is the decoded (not oriented) image. The returned rectangle is in upright image coordinates.
+//
+// The image is scaled down to SMART_CROP_SIZE and each pixel is given a score.
+// The window is moved along the axis with space to move and the position with the highest score is chosen.
+// If the scores are equal the position nearest the centre is chosen.
+//
+func smartCropRect(img image.Image, orientation int, cw, ch int, strategy string) image.Rectangle {
+	b := img.Bounds()
+	uw, uh := orientedSize(b.Dx(), b.Dy(), orientation)
+	centre := image.Rect((uw-cw)/2, (uh-ch)/2, (uw-cw)/2+cw, (uh-ch)/2+ch)
+	if strategy == CROP_CENTRE || (cw >= uw && ch >= uh) {
+		return centre
+	}
+
+	scale := float64(SMART_CROP_SIZE) / float64(maxInt(b.Dx(), b.Dy()))
+	if scale > 1 {
+		scale = 1
+	}
+	small := resample(img, maxInt(int(float64(b.Dx())*scale), 1), maxInt(int(float64(b.Dy())*scale), 1), FILTER_BILINEAR)
+	small = orientImage(small, orientation, "")
+	sw, sh := small.Bounds().Dx(), small.Bounds().Dy()
+	sx := float64(sw) / float64(uw)
+	sy := float64(sh) / float64(uh)
+	ww := minInt(maxInt(int(math.Round(float64(cw)*sx)), 1), sw)
+	wh := minInt(maxInt(int(math.Round(float64(ch)*sy)), 1), sh)
+
+	horizontal := sw-ww >= sh-wh
+	steps := sh - wh
+	if horizontal {
+		steps = sw - ww
+	}
+	if steps < 1 {
+		return centre
+	}
+
+	var scoreWindow func(x, y int) float64
+	if strategy == CROP_ENTROPY {
+		lum := lumaMap(small)
+		scoreWindow = func(x, y int) float64 {
+			return windowEntropy(lum, sw, x, y, ww, wh)
+		}
+	} else {
+		var scores []float64
+		if strategy == CROP_SATURATION {
+			scores = saturationMap(small)
+		} else {
+			scores = edgeMap(lumaMap(small), sw, sh)
+		}
+		scoreWindow = func(x, y int) float64 {
+			return windowSum(scores, sw, x, y, ww, wh)
+		}
+	}
+
+	best := -1.0
+	bestPos := steps / 2
+	for pos := 0; pos <= steps; pos++ {
+		var score float64
+		if horizontal {
+			score = scoreWindow(pos, 0)
+		} else {
+			score = scoreWindow(0, pos)
+		}
+		if score > best || (score == best && absInt(pos-steps/2) < absInt(bestPos-steps/2)) {
+			best = score
+			bestPos = pos
+		}
+	}
+
+	if horizontal {
+		x := minInt(maxInt(int(math.Round(float64(bestPos)/sx)), 0), uw-cw)
+		return image.Rect(x, centre.Min.Y, x+cw, centre.Max.Y)
+	}
+	y := minInt(maxInt(int(math.Round(float64(bestPos)/sy)), 0), uh-ch)
+	return image.Rect(centre.Min.X, y, centre.Max.X, y+ch)
+}
+
+//
+// Luminance 0..255 for each pixel
+//
+func lumaMap(img *image.RGBA) []float64 {
+	b := img.Bounds()
+	lum := make([]float64, b.Dx()*b.Dy())
+	i := 0
+	for y := 0; y < b.Dy(); y++ {
+		p := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := 0; x < b.Dx(); x++ {
+			lum[i] = 0.299*float64(p[x*4]) + 0.587*float64(p[x*4+1]) + 0.114*float64(p[x*4+2])
+			i++
+		}
+	}
+	return lum
+}
+
+//
+// Edge strength for each pixel. The absolute difference from the neighbours (Laplacian).
+//
+func edgeMap(lum []float64, w, h int) []float64 {
+	edges := make([]float64, len(lum))
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			edges[i] = math.Abs(4*lum[i] - lum[i-1] - lum[i+1] - lum[i-w] - lum[i+w])
+		}
+	}
+	return edges
+}
+
+//
+// Colour saturation for each pixel. (max - min) / max
+//
+func saturationMap(img *image.RGBA) []float64 {
+	b := img.Bounds()
+	sat := make([]float64, b.Dx()*b.Dy())
+	i := 0
+	for y := 0; y < b.Dy(); y++ {
+		p := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := 0; x < b.Dx(); x++ {
+			mx := maxInt(int(p[x*4]), maxInt(int(p[x*4+1]), int(p[x*4+2])))
+			mn := minInt(int(p[x*4]), minInt(int(p[x*4+1]), int(p[x*4+2])))
+			if mx > 0 {
+				sat[i] = float64(mx-mn) / float64(mx)
+			}
+			i++
+		}
+	}
+	return sat
+}
+
+func windowSum(scores []float64, w, x, y, ww, wh int) float64 {
+	sum := 0.0
+	for j := y; j < y+wh; j++ {
+		row := scores[j*w:]
+		for i := x; i < x+ww; i++ {
+			sum += row[i]
+		}
+	}
+	return sum
+}
+
+//
+// Shannon entropy of the luminance histogram (32 bins) within the window.
+//
+func windowEntropy(lum []float64, w, x, y, ww, wh int) float64 {
+	var hist [32]int
+	for j := y; j < y+wh; j++ {
+		row := lum[j*w:]
+		for i := x; i < x+ww; i++ {
+			hist[minInt(int(row[i])/8, 31)]++
+		}
+	}
+	total := float64(ww * wh)
+	e := 0.0
+	for _, c := range hist {
+		if c > 0 {
+			p := float64(c) / total
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSmartCropRect(t *testing.T) {
+	//
+	// 300x100 grey image with a coloured checker board at the left or the bottom
+	//
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	fillTestImage(img, image.Rect(0, 0, 300, 100), image.Rect(0, 0, 100, 100))
+	assertSmartCrop(t, "001", img, 1, CROP_EDGES, image.Rect(0, 0, 100, 100))
+	assertSmartCrop(t, "002", img, 1, CROP_ENTROPY, image.Rect(0, 0, 100, 100))
+	assertSmartCrop(t, "003", img, 1, CROP_SATURATION, image.Rect(0, 0, 100, 100))
+	assertSmartCrop(t, "004", img, 1, CROP_CENTRE, image.Rect(100, 0, 200, 100))
+	//
+	// Rotated clockwise the left of the source is the top of the upright image
+	//
+	assertSmartCrop(t, "005", img, 6, CROP_EDGES, image.Rect(0, 0, 100, 100))
+	//
+	// Rotated anticlockwise the left of the source is the bottom of the upright image
+	//
+	assertSmartCrop(t, "006", img, 8, CROP_EDGES, image.Rect(0, 200, 100, 300))
+	//
+	// No detail. Use the centre
+	//
+	flat := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	fillTestImage(flat, image.Rect(0, 0, 300, 100), image.Rectangle{})
+	assertSmartCrop(t, "007", flat, 1, CROP_EDGES, image.Rect(100, 0, 200, 100))
+}
+
+func fillTestImage(img *image.RGBA, all, detail image.Rectangle) {
+	for y := all.Min.Y; y < all.Max.Y; y++ {
+		for x := all.Min.X; x < all.Max.X; x++ {
+			c := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+			if (image.Point{X: x, Y: y}).In(detail) && (x/5+y/5)%2 == 0 {
+				c = color.RGBA{R: 255, G: 0, B: 0, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+func assertSmartCrop(t *testing.T, id string, img image.Image, orientation int, strategy string, expected image.Rectangle) {
+	r := smartCropRect(img, orientation, 100, 100, strategy)
+	//
+	// The small copy used for scoring is about 1/3 of the size so allow a few (small) pixels either way
+	//
+	if absInt(r.Min.X-expected.Min.X) > 10 || absInt(r.Min.Y-expected.Min.Y) > 10 || r.Dx() != expected.Dx() || r.Dy() != expected.Dy() {
+		t.Fatalf("Failed: id:%s expected:%s actual:%s", id, expected, r)
+	}
+}
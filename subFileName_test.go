@@ -19,6 +19,35 @@ func TestSubFileName(t *testing.T) {
 	assertSFN(t, "003", subFileName(tim, "%n.%x", "name", "jpg"), "name.jpg")
 	assertSFN(t, "002", subFileName(tim, "%n", "name", "jpg"), "name")
 	assertSFN(t, "001", subFileName(tim, "", "name", "jpg"), "")
+
+	timMs := tim.Add(7 * time.Millisecond)
+	assertSFN(t, "010", subFileName(timMs, "%s_%SSS_%n.%x", "name", "jpg"), "00_007_name.jpg")
+	assertSFN(t, "009", subFileName(tim, "%SSS", "name", "jpg"), "000")
+}
+
+func TestSubSecParseStr(t *testing.T) {
+	assertSSP(t, "001", "12", 120*time.Millisecond)
+	assertSSP(t, "002", "007", 7*time.Millisecond)
+	assertSSP(t, "003", " 5\x00", 500*time.Millisecond)
+	assertSSP(t, "004", "123456", 123456*time.Microsecond)
+	_, err := subSecParseStr("ab")
+	if err == nil {
+		t.Fatalf("Failed: id:005 'ab' should return an error")
+	}
+	_, err = subSecParseStr("  ")
+	if err == nil {
+		t.Fatalf("Failed: id:006 '  ' should return an error")
+	}
+}
+
+func assertSSP(t *testing.T, id, val string, expected time.Duration) {
+	d, err := subSecParseStr(val)
+	if err != nil {
+		t.Fatalf("Failed: id:%s error:%s", id, err.Error())
+	}
+	if d != expected {
+		t.Fatalf("Failed: id:%s expected:%s actual:%s", id, expected, d)
+	}
 }
 
 func assertSFN(t *testing.T, id, val, expected string) {
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	FIT_SHORT   = "short"
+	FIT_LONG    = "long"
+	FIT_CONTAIN = "contain"
+	FIT_COVER   = "cover"
+
+	FIT_ARG     = "fit="
+	WIDTH_ARG   = "width="
+	HEIGHT_ARG  = "height="
+	CROP_ARG    = "crop="
+	FILTER_ARG  = "filter="
+	SHARPEN_ARG = "sharpen="
+	PREVIEW_ARG = "preview="
+
+	NOUPSCALE_ARG = "noupscale="
+	SMALL_ARG     = "small="
+
+	SMALL_REENCODE    = "reencode"
+	SMALL_PASSTHROUGH = "passthrough"
+
+	MAX_LONG_ARG   = "maxlong="
+	MAX_ASPECT_ARG = "maxaspect="
+	PANORAMA_ARG   = "panorama="
+
+	PANORAMA_SCALE = "scale"
+	PANORAMA_CROP  = "crop"
+
+	// The range of the thumbnail size, width and height (command line and query)
+	THUMB_MIN_SIZE = 10
+	THUMB_MAX_SIZE = 1000
+	MAX_LONG_MAX   = 10000 // The largest maxlong. 0 is no limit
+)
+
+//
+// Options that control how a thumbnail is created.
+// Defaults come from the command line args. The server can override them per request.
+//
+type ThumbOptions struct {
+	size       int
+	width      int
+	height     int
+	fit        string
+	crop       string
+	filter     string
+	sharpen    float64
+	preview    bool
+	limits     *ImageLimits
+	animate    bool
+	maxFrames  int
+	maxAnimKb  int
+	background color.RGBA
+	noUpscale  bool
+	small      string
+	maxLong    int
+	maxAspect  float64
+	panorama   string
+	watermark  *Watermark
+	enhance    Enhance
+	icc        bool
+	grey       string
+	video      string
+}
+
+//
+// Details of how a thumbnail was created.
+// crop is in upright (oriented) source image coordinates. It is empty if the image was not cropped.
+// preview is true if the EXIF embedded preview was used instead of the image.
+// frames is the number of frames in an animated thumbnail. 0 if not animated.
+// noUpscale is true if the thumbnail is the image size because the image is smaller than the requested size.
+// icc is the description of the embedded colour profile. iccConverted is true if the pixels were converted to sRGB.
+// iccWarning is set if the profile is not supported.
+// colourModel is the colour model of the source image. rgb, grey or cmyk.
+//
+type ThumbInfo struct {
+	width        int
+	height       int
+	crop         image.Rectangle
+	preview      bool
+	frames       int
+	noUpscale    bool
+	icc          string
+	iccConverted bool
+	iccWarning   string
+	colourModel  string
+}
+
+func NewThumbOptions(size int) *ThumbOptions {
+	return &ThumbOptions{size: size, width: 0, height: 0, fit: FIT_SHORT, crop: CROP_CENTRE, filter: FILTER_CATMULLROM, sharpen: 0, limits: NewImageLimits(100*MEGA, 100*MEGA, 400*MEGA), animate: false, maxFrames: 100, maxAnimKb: 2048, background: COLOUR_NAMES["white"], noUpscale: false, small: SMALL_REENCODE, maxLong: 0, maxAspect: 0, panorama: PANORAMA_SCALE, icc: true, grey: GREY_RGB, video: VIDEO_SKIP}
+}
+
+//
+// Read the options from the command line args.
+// server is true when running as a server. It changes the default for the preview= and noupscale= args.
+//
+func NewThumbOptionsFromArgs(size int, server bool) (*ThumbOptions, error) {
+	opts := NewThumbOptions(size)
+	var err error
+	opts.preview, err = validBool(PREVIEW_ARG, findStringArg(PREVIEW_ARG, strconv.FormatBool(server)))
+	if err != nil {
+		return nil, err
+	}
+	opts.noUpscale, err = validBool(NOUPSCALE_ARG, findStringArg(NOUPSCALE_ARG, strconv.FormatBool(server)))
+	if err != nil {
+		return nil, err
+	}
+	opts.small, err = validSmall(findStringArg(SMALL_ARG, SMALL_REENCODE))
+	if err != nil {
+		return nil, err
+	}
+	opts.fit, err = validFit(findStringArg(FIT_ARG, FIT_SHORT))
+	if err != nil {
+		return nil, err
+	}
+	opts.crop, err = validCrop(findStringArg(CROP_ARG, CROP_CENTRE))
+	if err != nil {
+		return nil, err
+	}
+	opts.filter, err = validFilter(findStringArg(FILTER_ARG, FILTER_CATMULLROM))
+	if err != nil {
+		return nil, err
+	}
+	opts.sharpen, err = validSharpen(findStringArg(SHARPEN_ARG, "0"))
+	if err != nil {
+		return nil, err
+	}
+	opts.width, err = findIntArg(WIDTH_ARG, 0, THUMB_MAX_SIZE, 0)
+	if err != nil {
+		return nil, err
+	}
+	opts.height, err = findIntArg(HEIGHT_ARG, 0, THUMB_MAX_SIZE, 0)
+	if err != nil {
+		return nil, err
+	}
+	opts.limits, err = NewImageLimitsFromArgs()
+	if err != nil {
+		return nil, err
+	}
+	opts.animate, err = validBool(ANIMATE_ARG, findStringArg(ANIMATE_ARG, "false"))
+	if err != nil {
+		return nil, err
+	}
+	opts.maxFrames, err = findIntArg(MAX_FRAMES_ARG, 2, 10000, 100)
+	if err != nil {
+		return nil, err
+	}
+	opts.maxAnimKb, err = findIntArg(MAX_ANIM_KB_ARG, 1, 100000, 2048)
+	if err != nil {
+		return nil, err
+	}
+	opts.maxLong, err = findIntArg(MAX_LONG_ARG, 0, MAX_LONG_MAX, 0)
+	if err != nil {
+		return nil, err
+	}
+	opts.maxAspect, err = validMaxAspect(findStringArg(MAX_ASPECT_ARG, "0"))
+	if err != nil {
+		return nil, err
+	}
+	opts.panorama, err = validPanorama(findStringArg(PANORAMA_ARG, PANORAMA_SCALE))
+	if err != nil {
+		return nil, err
+	}
+	opts.watermark, err = NewWatermarkFromArgs()
+	if err != nil {
+		return nil, err
+	}
+	opts.enhance, err = validEnhance(findStringArg(ENHANCE_ARG, ENHANCE_OFF))
+	if err != nil {
+		return nil, err
+	}
+	opts.icc, err = validBool(ICC_ARG, findStringArg(ICC_ARG, "true"))
+	if err != nil {
+		return nil, err
+	}
+	opts.grey, err = validGrey(findStringArg(GREY_ARG, GREY_RGB))
+	if err != nil {
+		return nil, err
+	}
+	opts.background, err = validColour(BACKGROUND_ARG, findStringArg(BACKGROUND_ARG, "white"))
+	if err != nil {
+		return nil, err
+	}
+	opts.video, err = validVideo(findStringArg(VIDEO_ARG, VIDEO_SKIP))
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+//
+// Return a copy of the options updated from the server location config.
+//
+func (o *ThumbOptions) WithLocation(loc *Location) *ThumbOptions {
+	opts := *o
+	if loc != nil && loc.background != nil {
+		opts.background = *loc.background
+	}
+	if loc != nil && loc.watermark != nil {
+		opts.watermark = loc.watermark
+	}
+	return &opts
+}
+
+//
+// Return a copy of the options updated from the request query.
+//
+//    thumbnail=n fit=short|long|contain|cover width=n height=n crop=centre|edges|entropy|saturation
+//    filter=nearest|bilinear|catmullrom|lanczos sharpen=0..2 preview=true|false animate=true|false
+//    background=white|black|grey|RRGGBB noupscale=true|false small=reencode|passthrough
+//    maxlong=n maxaspect=n panorama=scale|crop enhance=off|auto,contrast,whitebalance icc=true|false grey=rgb|keep
+//
+func (o *ThumbOptions) WithQuery(q url.Values) (*ThumbOptions, error) {
+	opts := *o
+	tn := strings.TrimSpace(q.Get("thumbnail"))
+	if tn != "" {
+		// thumbnail=true uses the default size
+		i, err := strconv.Atoi(tn)
+		if err == nil {
+			if i < THUMB_MIN_SIZE || i > THUMB_MAX_SIZE {
+				return nil, fmt.Errorf("thumbnail=%d must be %d..%d", i, THUMB_MIN_SIZE, THUMB_MAX_SIZE)
+			}
+			opts.size = i
+		}
+	}
+	fit := strings.TrimSpace(q.Get("fit"))
+	if fit != "" {
+		f, err := validFit(fit)
+		if err != nil {
+			return nil, err
+		}
+		opts.fit = f
+	}
+	crop := strings.TrimSpace(q.Get("crop"))
+	if crop != "" {
+		c, err := validCrop(crop)
+		if err != nil {
+			return nil, err
+		}
+		opts.crop = c
+	}
+	filter := strings.TrimSpace(q.Get("filter"))
+	if filter != "" {
+		f, err := validFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		opts.filter = f
+	}
+	sharpen := strings.TrimSpace(q.Get("sharpen"))
+	if sharpen != "" {
+		sh, err := validSharpen(sharpen)
+		if err != nil {
+			return nil, err
+		}
+		opts.sharpen = sh
+	}
+	preview := strings.TrimSpace(q.Get("preview"))
+	if preview != "" {
+		p, err := validBool("preview=", preview)
+		if err != nil {
+			return nil, err
+		}
+		opts.preview = p
+	}
+	animate := strings.TrimSpace(q.Get("animate"))
+	if animate != "" {
+		a, err := validBool("animate=", animate)
+		if err != nil {
+			return nil, err
+		}
+		opts.animate = a
+	}
+	background := strings.TrimSpace(q.Get("background"))
+	if background != "" {
+		c, err := validColour("background=", background)
+		if err != nil {
+			return nil, err
+		}
+		opts.background = c
+	}
+	noUpscale := strings.TrimSpace(q.Get("noupscale"))
+	if noUpscale != "" {
+		n, err := validBool("noupscale=", noUpscale)
+		if err != nil {
+			return nil, err
+		}
+		opts.noUpscale = n
+	}
+	small := strings.TrimSpace(q.Get("small"))
+	if small != "" {
+		sm, err := validSmall(small)
+		if err != nil {
+			return nil, err
+		}
+		opts.small = sm
+	}
+	icc := strings.TrimSpace(q.Get("icc"))
+	if icc != "" {
+		i, err := validBool("icc=", icc)
+		if err != nil {
+			return nil, err
+		}
+		opts.icc = i
+	}
+	grey := strings.TrimSpace(q.Get("grey"))
+	if grey != "" {
+		g, err := validGrey(grey)
+		if err != nil {
+			return nil, err
+		}
+		opts.grey = g
+	}
+	enhance := strings.TrimSpace(q.Get("enhance"))
+	if enhance != "" {
+		e, err := validEnhance(enhance)
+		if err != nil {
+			return nil, err
+		}
+		opts.enhance = e
+	}
+	maxAspect := strings.TrimSpace(q.Get("maxaspect"))
+	if maxAspect != "" {
+		a, err := validMaxAspect(maxAspect)
+		if err != nil {
+			return nil, err
+		}
+		opts.maxAspect = a
+	}
+	panorama := strings.TrimSpace(q.Get("panorama"))
+	if panorama != "" {
+		p, err := validPanorama(panorama)
+		if err != nil {
+			return nil, err
+		}
+		opts.panorama = p
+	}
+	maxLong := strings.TrimSpace(q.Get("maxlong"))
+	if maxLong != "" {
+		i, err := strconv.Atoi(maxLong)
+		if err != nil || i < 0 || i > MAX_LONG_MAX {
+			return nil, fmt.Errorf("maxlong=%s must be an int 0..%d. 0 is no limit", maxLong, MAX_LONG_MAX)
+		}
+		opts.maxLong = i
+	}
+	for _, n := range []string{"width", "height"} {
+		v := strings.TrimSpace(q.Get(n))
+		if v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 1 || i > THUMB_MAX_SIZE {
+				return nil, fmt.Errorf("%s=%s must be an int 1..%d", n, v, THUMB_MAX_SIZE)
+			}
+			if n == "width" {
+				opts.width = i
+			} else {
+				opts.height = i
+			}
+		}
+	}
+	return &opts, nil
+}
+
+func validFit(fit string) (string, error) {
+	f := strings.ToLower(strings.TrimSpace(fit))
+	switch f {
+	case FIT_SHORT, FIT_LONG, FIT_CONTAIN, FIT_COVER:
+		return f, nil
+	}
+	return "", fmt.Errorf("fit=%s is invalid. Use %s, %s, %s or %s", fit, FIT_SHORT, FIT_LONG, FIT_CONTAIN, FIT_COVER)
+}
+
+func validBool(name, value string) (bool, error) {
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return false, fmt.Errorf("%s%s is invalid. Use true or false", name, value)
+	}
+	return b, nil
+}
+
+func validSmall(small string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(small))
+	switch s {
+	case SMALL_REENCODE, SMALL_PASSTHROUGH:
+		return s, nil
+	}
+	return "", fmt.Errorf("small=%s is invalid. Use %s or %s", small, SMALL_REENCODE, SMALL_PASSTHROUGH)
+}
+
+func validMaxAspect(aspect string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(aspect), 64)
+	if err != nil || (f != 0 && f < 1) {
+		return 0, fmt.Errorf("maxaspect=%s is invalid. Use 0 (no limit) or a number of 1 or more", aspect)
+	}
+	return f, nil
+}
+
+func validPanorama(panorama string) (string, error) {
+	p := strings.ToLower(strings.TrimSpace(panorama))
+	switch p {
+	case PANORAMA_SCALE, PANORAMA_CROP:
+		return p, nil
+	}
+	return "", fmt.Errorf("panorama=%s is invalid. Use %s or %s", panorama, PANORAMA_SCALE, PANORAMA_CROP)
+}
+
+func validSharpen(sharpen string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(sharpen), 64)
+	if err != nil || f < 0 || f > 2 {
+		return 0, fmt.Errorf("sharpen=%s is invalid. Use a number from 0 to 2", sharpen)
+	}
+	return f, nil
+}
+
+//
+// The target box. If width or height are not defined then size is used.
+//
+func (o *ThumbOptions) box() (int, int) {
+	w, h := o.width, o.height
+	if w < 1 {
+		w = o.size
+	}
+	if h < 1 {
+		h = o.size
+	}
+	return w, h
+}
+
+//
+// Return the thumbnail size for an (upright) image of w x h.
+// If the long side is over the limit (see longLimit) the thumbnail is scaled down further.
+//
+func (o *ThumbOptions) scaleSize(w, h int) (int, int) {
+	sw, sh := o.fitSize(w, h)
+	lim := o.longLimit(sw, sh)
+	if lim < 1 || maxInt(sw, sh) <= lim {
+		return sw, sh
+	}
+	scale := float64(lim) / float64(maxInt(sw, sh))
+	return maxInt(int(math.Round(float64(sw)*scale)), 1), maxInt(int(math.Round(float64(sh)*scale)), 1)
+}
+
+//
+// The maximum long side for a thumbnail of w x h. 0 if there is no limit.
+// It is the smaller of maxLong and the short side * maxAspect.
+//
+func (o *ThumbOptions) longLimit(w, h int) int {
+	lim := o.maxLong
+	if o.maxAspect > 0 {
+		a := int(math.Round(float64(minInt(w, h)) * o.maxAspect))
+		if lim < 1 || a < lim {
+			lim = a
+		}
+	}
+	return lim
+}
+
+//
+// Return the thumbnail size for an (upright) image of w x h using fit.
+//
+//    short   The short side is size.
+//    long    The long side is size.
+//    contain The whole image fits inside the width x height box.
+//    cover   The image covers the width x height box. See cropRect.
+//
+func (o *ThumbOptions) fitSize(w, h int) (int, int) {
+	var scale float64
+	switch o.fit {
+	case FIT_LONG:
+		scale = float64(o.size) / float64(maxInt(w, h))
+	case FIT_CONTAIN:
+		bw, bh := o.box()
+		scale = math.Min(float64(bw)/float64(w), float64(bh)/float64(h))
+	case FIT_COVER:
+		bw, bh := o.box()
+		scale = math.Max(float64(bw)/float64(w), float64(bh)/float64(h))
+	default:
+		sw, sh := thumbSize(image.Rect(0, 0, w, h), o.size)
+		return maxInt(sw, 1), maxInt(sh, 1)
+	}
+	return maxInt(int(math.Round(float64(w)*scale)), 1), maxInt(int(math.Round(float64(h)*scale)), 1)
+}
+
+//
+// Return the thumbnail size for an (upright) image of w x h after the fit=cover crop.
+// If noUpscale and the image is smaller than the thumbnail then the (cropped) image size is returned with true.
+//
+func (o *ThumbOptions) effectiveSize(w, h int) (int, int, bool) {
+	crop := o.cropRect(w, h)
+	sw, sh := o.scaleSize(crop.Dx(), crop.Dy())
+	if o.noUpscale && (sw > crop.Dx() || sh > crop.Dy()) {
+		return crop.Dx(), crop.Dy(), true
+	}
+	return sw, sh, false
+}
+
+//
+// The pixels that resample and the thumbnail need for a w x h (not oriented) source.
+// The first is the horizontal pass buffer. It holds 4 floats (16 bytes, the size of 4 RGBA pixels)
+// for each thumbnail column of each source row. The second is the thumbnail, counted twice as it is
+// copied when it is rotated, flattened and sharpened.
+//
+func (o *ThumbOptions) resamplePixels(w, h, orientation int) (int64, int64) {
+	uw, uh := orientedSize(w, h, orientation)
+	crop := o.cropRect(uw, uh)
+	sw, sh, _ := o.effectiveSize(uw, uh)
+	tw, _ := orientedSize(sw, sh, orientation)
+	_, rows := orientedSize(crop.Dx(), crop.Dy(), orientation)
+	if orientation != 1 && crop.Dx()*crop.Dy() < sw*sh {
+		// The source is rotated before it is scaled (see createThumbImage)
+		tw, rows = sw, crop.Dy()
+	}
+	return 4 * int64(tw) * int64(rows), 2 * int64(sw) * int64(sh)
+}
+
+//
+// Return the area of an (upright) w x h image used for the thumbnail.
+// With panorama=crop the centre of the long side is used if the thumbnail long side is over the limit (see longLimit).
+//
+func (o *ThumbOptions) cropRect(w, h int) image.Rectangle {
+	crop := o.fitCropRect(w, h)
+	if o.panorama != PANORAMA_CROP {
+		return crop
+	}
+	cw, ch := crop.Dx(), crop.Dy()
+	tw, th := o.fitSize(cw, ch)
+	lim := o.longLimit(tw, th)
+	if lim < 1 || maxInt(tw, th) <= lim {
+		return crop
+	}
+	if tw > th {
+		nw := minInt(maxInt(int(math.Round(float64(cw)*float64(lim)/float64(tw))), 1), cw)
+		x := crop.Min.X + (cw-nw)/2
+		return image.Rect(x, crop.Min.Y, x+nw, crop.Max.Y)
+	}
+	nh := minInt(maxInt(int(math.Round(float64(ch)*float64(lim)/float64(th))), 1), ch)
+	y := crop.Min.Y + (ch-nh)/2
+	return image.Rect(crop.Min.X, y, crop.Max.X, y+nh)
+}
+
+//
+// For fit=cover return the centred area of an (upright) w x h image with the same aspect ratio as the box.
+// For other fit values the whole image is returned.
+//
+func (o *ThumbOptions) fitCropRect(w, h int) image.Rectangle {
+	full := image.Rect(0, 0, w, h)
+	if o.fit != FIT_COVER {
+		return full
+	}
+	bw, bh := o.box()
+	cw := minInt(w, int(math.Round(float64(h)*float64(bw)/float64(bh))))
+	ch := minInt(h, int(math.Round(float64(w)*float64(bh)/float64(bw))))
+	x := (w - cw) / 2
+	y := (h - ch) / 2
+	return image.Rect(x, y, x+cw, y+ch)
+}
+
+func (o *ThumbOptions) String() string {
+	bw, bh := o.box()
+	return fmt.Sprintf("size:%d fit:%s box:%dx%d crop:%s filter:%s sharpen:%g preview:%t animate:%t background:%s noupscale:%t small:%s maxlong:%d maxaspect:%g panorama:%s enhance:%s icc:%t grey:%s", o.size, o.fit, bw, bh, o.crop, o.filter, o.sharpen, o.preview, o.animate, colourString(o.background), o.noUpscale, o.small, o.maxLong, o.maxAspect, o.panorama, o.enhance, o.icc, o.grey)
+}
+
+//
+// The crop rectangle as "x,y,w,h". Empty if not cropped.
+//
+func (i *ThumbInfo) CropString() string {
+	if i.crop.Empty() {
+		return ""
+	}
+	return fmt.Sprintf("%d,%d,%d,%d", i.crop.Min.X, i.crop.Min.Y, i.crop.Dx(), i.crop.Dy())
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
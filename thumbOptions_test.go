@@ -0,0 +1,132 @@
+package main
+
+import (
+	"image"
+	"net/url"
+	"testing"
+)
+
+func TestScaleSize(t *testing.T) {
+	opts := NewThumbOptions(200)
+	assertSize(t, "001", opts, 400, 300, 266, 200)
+	assertSize(t, "002", opts, 300, 400, 200, 266)
+	opts.fit = FIT_LONG
+	assertSize(t, "003", opts, 4000, 400, 200, 20)
+	assertSize(t, "004", opts, 300, 400, 150, 200)
+	opts.fit = FIT_CONTAIN
+	opts.width, opts.height = 200, 100
+	assertSize(t, "005", opts, 400, 300, 133, 100)
+	assertSize(t, "006", opts, 4000, 300, 200, 15)
+	opts.fit = FIT_COVER
+	opts.width, opts.height = 0, 0
+	assertSize(t, "007", opts, 400, 300, 267, 200)
+	assertCrop(t, "008", opts, 400, 300, image.Rect(50, 0, 350, 300))
+	assertCrop(t, "009", opts, 300, 400, image.Rect(0, 50, 300, 350))
+	opts.fit = FIT_SHORT
+	assertCrop(t, "010", opts, 300, 400, image.Rect(0, 0, 300, 400))
+}
+
+func TestSourceRect(t *testing.T) {
+	//
+	// Source 4x2 at offset 10,10. Upright (rotated 90) is 2x4. Top left 1x1 of the upright image
+	//
+	b := image.Rect(10, 10, 14, 12)
+	r := image.Rect(0, 0, 1, 1)
+	assertRect(t, "001", sourceRect(r, b, 1), image.Rect(10, 10, 11, 11))
+	assertRect(t, "002", sourceRect(r, b, 6), image.Rect(10, 11, 11, 12))
+	assertRect(t, "003", sourceRect(r, b, 8), image.Rect(13, 10, 14, 11))
+	assertRect(t, "004", sourceRect(r, b, 3), image.Rect(13, 11, 14, 12))
+	assertRect(t, "005", sourceRect(r, b, 5), image.Rect(10, 10, 11, 11))
+	assertRect(t, "006", sourceRect(r, b, 7), image.Rect(13, 11, 14, 12))
+}
+
+func TestWithQuery(t *testing.T) {
+	opts := NewThumbOptions(200)
+	q, _ := url.ParseQuery("thumbnail=100&fit=Cover&width=50")
+	o, err := opts.WithQuery(q)
+	if err != nil {
+		t.Fatalf("Failed: id:001 error:%s", err.Error())
+	}
+	if o.size != 100 || o.fit != FIT_COVER || o.width != 50 || o.height != 0 || opts.size != 200 {
+		t.Fatalf("Failed: id:002 %s", o)
+	}
+	q, _ = url.ParseQuery("thumbnail=true&fit=stretch")
+	_, err = opts.WithQuery(q)
+	if err == nil {
+		t.Fatalf("Failed: id:003 fit=stretch should fail")
+	}
+	q, _ = url.ParseQuery("thumbnail=true&height=0")
+	_, err = opts.WithQuery(q)
+	if err == nil {
+		t.Fatalf("Failed: id:004 height=0 should fail")
+	}
+	for i, query := range []string{"thumbnail=9", "thumbnail=1001", "thumbnail=100000000", "width=1001", "height=99999999", "maxlong=-1", "maxlong=10001"} {
+		q, _ = url.ParseQuery(query)
+		_, err = opts.WithQuery(q)
+		if err == nil {
+			t.Fatalf("Failed: id:%03d %s should fail", i+5, query)
+		}
+	}
+	q, _ = url.ParseQuery("thumbnail=1000&width=1000&height=1000&maxlong=10000")
+	o, err = opts.WithQuery(q)
+	if err != nil || o.size != 1000 || o.width != 1000 || o.height != 1000 || o.maxLong != 10000 {
+		t.Fatalf("Failed: id:010 the maximum size should pass. %v", err)
+	}
+}
+
+func assertSize(t *testing.T, id string, opts *ThumbOptions, w, h, ew, eh int) {
+	sw, sh := opts.scaleSize(w, h)
+	if sw != ew || sh != eh {
+		t.Fatalf("Failed: id:%s %s expected:%dx%d actual:%dx%d", id, opts, ew, eh, sw, sh)
+	}
+}
+
+func assertCrop(t *testing.T, id string, opts *ThumbOptions, w, h int, expected image.Rectangle) {
+	assertRect(t, id, opts.cropRect(w, h), expected)
+}
+
+func assertRect(t *testing.T, id string, r, expected image.Rectangle) {
+	if !r.Eq(expected) {
+		t.Fatalf("Failed: id:%s expected:%s actual:%s", id, expected, r)
+	}
+}
+
+func TestEffectiveSize(t *testing.T) {
+	opts := NewThumbOptions(200)
+	w, h, small := opts.effectiveSize(120, 80)
+	if w != 300 || h != 200 || small {
+		t.Fatalf("Failed: id:001 %dx%d %t", w, h, small)
+	}
+	opts.noUpscale = true
+	w, h, small = opts.effectiveSize(120, 80)
+	if w != 120 || h != 80 || !small {
+		t.Fatalf("Failed: id:002 %dx%d %t", w, h, small)
+	}
+	w, h, small = opts.effectiveSize(400, 300)
+	if w != 266 || h != 200 || small {
+		t.Fatalf("Failed: id:003 %dx%d %t", w, h, small)
+	}
+	opts.fit = FIT_COVER
+	w, h, small = opts.effectiveSize(150, 100)
+	if w != 100 || h != 100 || !small {
+		t.Fatalf("Failed: id:004 %dx%d %t", w, h, small)
+	}
+}
+
+func TestPanorama(t *testing.T) {
+	opts := NewThumbOptions(200)
+	opts.maxLong = 800
+	assertSize(t, "001", opts, 2000, 200, 800, 80)
+	assertSize(t, "002", opts, 400, 300, 266, 200)
+	assertCrop(t, "003", opts, 2000, 200, image.Rect(0, 0, 2000, 200))
+	opts.panorama = PANORAMA_CROP
+	assertCrop(t, "004", opts, 2000, 200, image.Rect(600, 0, 1400, 200))
+	assertCrop(t, "005", opts, 200, 2000, image.Rect(0, 600, 200, 1400))
+	assertSize(t, "006", opts, 800, 200, 800, 200)
+	opts.maxLong = 0
+	opts.maxAspect = 3
+	assertCrop(t, "007", opts, 2000, 200, image.Rect(700, 0, 1300, 200))
+	opts.panorama = PANORAMA_SCALE
+	assertSize(t, "008", opts, 2000, 200, 600, 60)
+	assertCrop(t, "009", opts, 2000, 200, image.Rect(0, 0, 2000, 200))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VIDEO_ARG = "video="
+
+	VIDEO_SKIP = "skip"
+	VIDEO_COPY = "copy"
+
+	VIDEO_BOX_HEADER = 8
+)
+
+var (
+	// ISO-BMFF (QuickTime) video files. The meta data is read from the moov box. Videos are not decoded.
+	VIDEO_FILE_TYPES = map[string]string{
+		".mp4": "video/mp4",
+		".m4v": "video/x-m4v",
+		".mov": "video/quicktime",
+		".3gp": "video/3gpp",
+	}
+
+	// mvhd and tkhd times are seconds since 1904-01-01 UTC
+	VIDEO_EPOCH = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func init() {
+	// So videos are listed (see filesOfInterest)
+	for ext, mt := range VIDEO_FILE_TYPES {
+		mime.AddExtensionType(ext, mt)
+	}
+}
+
+//
+// Meta data for a video file from the mvhd (movie header) and tkhd (track header) boxes.
+//
+//    created  The creation time (UTC). Zero if it is not set.
+//    duration The length of the video.
+//    width    The upright width of the first video track. The track rotation is applied.
+//    height   The upright height of the first video track.
+//    rotation The rotation of the first video track in degrees. 0, 90, 180 or 270.
+//
+type VideoMeta struct {
+	created  time.Time
+	duration time.Duration
+	width    int
+	height   int
+	rotation int
+}
+
+func isVideoFile(fileName string) bool {
+	_, ok := VIDEO_FILE_TYPES[strings.ToLower(filepath.Ext(fileName))]
+	return ok
+}
+
+func validVideo(video string) (string, error) {
+	v := strings.ToLower(strings.TrimSpace(video))
+	switch v {
+	case VIDEO_SKIP, VIDEO_COPY:
+		return v, nil
+	}
+	return "", fmt.Errorf("video=%s is invalid. Use %s or %s", video, VIDEO_SKIP, VIDEO_COPY)
+}
+
+//
+// Call fn for each box in r between start and end. fn is given the box type and the start and end of its payload.
+// Boxes with a size of 1 have a 64 bit size. A size of 0 is the rest of the file.
+//
+func videoBoxes(r io.ReaderAt, start, end int64, fn func(boxType string, start, end int64) error) error {
+	header := make([]byte, 16)
+	for start+VIDEO_BOX_HEADER <= end {
+		_, err := r.ReadAt(header[:VIDEO_BOX_HEADER], start)
+		if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		boxType := string(header[4:8])
+		payload := start + VIDEO_BOX_HEADER
+		switch size {
+		case 0:
+			size = end - start
+		case 1:
+			_, err = r.ReadAt(header[8:16], payload)
+			if err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			payload += 8
+		}
+		if size < payload-start || start+size > end {
+			return fmt.Errorf("video box '%s' at %d has an invalid size %d", boxType, start, size)
+		}
+		err = fn(boxType, payload, start+size)
+		if err != nil {
+			return err
+		}
+		start += size
+	}
+	return nil
+}
+
+//
+// Read the meta data for an ISO-BMFF video (mp4, mov) of size bytes. Only the box headers and the
+// mvhd and tkhd boxes are read so the video data (mdat) is skipped.
+//
+func readVideoMeta(r io.ReaderAt, size int64) (*VideoMeta, error) {
+	var vm *VideoMeta
+	err := videoBoxes(r, 0, size, func(boxType string, start, end int64) error {
+		if boxType != "moov" || vm != nil {
+			return nil
+		}
+		vm = &VideoMeta{}
+		return videoBoxes(r, start, end, func(boxType string, start, end int64) error {
+			switch boxType {
+			case "mvhd":
+				return vm.readMvhd(r, start, end)
+			case "trak":
+				if vm.width > 0 {
+					return nil
+				}
+				return videoBoxes(r, start, end, func(boxType string, start, end int64) error {
+					if boxType == "tkhd" {
+						return vm.readTkhd(r, start, end)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if vm == nil {
+		return nil, fmt.Errorf("video has no moov box")
+	}
+	return vm, nil
+}
+
+func readVideoBox(r io.ReaderAt, start, end int64, n int) ([]byte, error) {
+	if end-start < 4 {
+		return nil, fmt.Errorf("video box at %d is too short", start)
+	}
+	b := make([]byte, n)
+	if int64(n) > end-start {
+		b = b[:end-start]
+	}
+	_, err := r.ReadAt(b, start)
+	if err != nil {
+		return nil, err
+	}
+	// Version 1 boxes have 64 bit times
+	if b[0] == 1 {
+		n += 12
+	}
+	if int64(n) > end-start {
+		return nil, fmt.Errorf("video box at %d is too short", start)
+	}
+	if len(b) < n {
+		b = make([]byte, n)
+		_, err = r.ReadAt(b, start)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b[:n], nil
+}
+
+//
+// The movie header. Version 0 has 32 bit times, version 1 has 64 bit times.
+//
+func (vm *VideoMeta) readMvhd(r io.ReaderAt, start, end int64) error {
+	b, err := readVideoBox(r, start, end, 20)
+	if err != nil {
+		return err
+	}
+	var created, duration uint64
+	var timescale uint32
+	if b[0] == 1 {
+		created = binary.BigEndian.Uint64(b[4:12])
+		timescale = binary.BigEndian.Uint32(b[20:24])
+		duration = binary.BigEndian.Uint64(b[24:32])
+	} else {
+		created = uint64(binary.BigEndian.Uint32(b[4:8]))
+		timescale = binary.BigEndian.Uint32(b[12:16])
+		duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+		if duration == 0xFFFFFFFF {
+			duration = 0
+		}
+	}
+	if created > 0 {
+		vm.created = VIDEO_EPOCH.Add(time.Duration(created) * time.Second)
+	}
+	if timescale > 0 {
+		vm.duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+	}
+	return nil
+}
+
+//
+// The track header. Audio tracks have a width and height of 0 and are ignored.
+// The matrix gives the rotation used by phones for portrait videos.
+//
+func (vm *VideoMeta) readTkhd(r io.ReaderAt, start, end int64) error {
+	b, err := readVideoBox(r, start, end, 84)
+	if err != nil {
+		return err
+	}
+	m := b[len(b)-44:]
+	fixed := func(i int) int32 {
+		return int32(binary.BigEndian.Uint32(m[i*4:]))
+	}
+	w := int(binary.BigEndian.Uint32(m[36:40]) >> 16)
+	h := int(binary.BigEndian.Uint32(m[40:44]) >> 16)
+	if w == 0 || h == 0 {
+		return nil
+	}
+	// The matrix is a b u c d v x y w
+	a, bb, c, d := fixed(0), fixed(1), fixed(3), fixed(4)
+	switch {
+	case a == 0 && d == 0 && bb > 0 && c < 0:
+		vm.rotation = 90
+	case a == 0 && d == 0 && bb < 0 && c > 0:
+		vm.rotation = 270
+	case a < 0 && d < 0:
+		vm.rotation = 180
+	}
+	if vm.rotation == 90 || vm.rotation == 270 {
+		w, h = h, w
+	}
+	vm.width, vm.height = w, h
+	return nil
+}
+
+//
+// The creation time is an instant. EXIF, XMP and file name times are the wall clock with no zone and are held as UTC.
+// The local wall clock of the creation time is returned in the same way so the times can be sorted and grouped together.
+//
+func (vm *VideoMeta) wallClock() time.Time {
+	l := vm.created.Local()
+	return time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), l.Nanosecond(), time.UTC)
+}
+
+func (vm *VideoMeta) addTo(jf *JsonFields) *JsonFields {
+	jf.AddRaw("video", "true")
+	jf.AddRaw("width", fmt.Sprintf("%d", vm.width))
+	jf.AddRaw("height", fmt.Sprintf("%d", vm.height))
+	jf.AddRaw("duration", strconv.FormatFloat(vm.duration.Seconds(), 'f', 3, 64))
+	if vm.rotation != 0 {
+		jf.AddRaw("rotation", fmt.Sprintf("%d", vm.rotation))
+	}
+	return jf
+}
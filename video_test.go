@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testVideoBox(boxType string, payload ...[]byte) []byte {
+	size := VIDEO_BOX_HEADER
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(size))
+	b = append(b, boxType...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+//
+// A version 0 or 1 mvhd box. Only the fields that are read are set.
+//
+func testVideoMvhd(version byte, created uint64, timescale uint32, duration uint64) []byte {
+	b := []byte{version, 0, 0, 0}
+	if version == 1 {
+		b = binary.BigEndian.AppendUint64(b, created)
+		b = binary.BigEndian.AppendUint64(b, created)
+		b = binary.BigEndian.AppendUint32(b, timescale)
+		b = binary.BigEndian.AppendUint64(b, duration)
+	} else {
+		b = binary.BigEndian.AppendUint32(b, uint32(created))
+		b = binary.BigEndian.AppendUint32(b, uint32(created))
+		b = binary.BigEndian.AppendUint32(b, timescale)
+		b = binary.BigEndian.AppendUint32(b, uint32(duration))
+	}
+	return testVideoBox("mvhd", b, make([]byte, 80))
+}
+
+//
+// A version 0 tkhd box. a, b, c and d are the rotation part of the matrix (16.16 fixed point).
+//
+func testVideoTkhd(w, h int, a, b, c, d int32) []byte {
+	p := make([]byte, 40)
+	m := []int32{a, b, 0, c, d, 0, 0, 0, 0x40000000}
+	for _, v := range m {
+		p = binary.BigEndian.AppendUint32(p, uint32(v))
+	}
+	p = binary.BigEndian.AppendUint32(p, uint32(w)<<16)
+	p = binary.BigEndian.AppendUint32(p, uint32(h)<<16)
+	return testVideoBox("tkhd", p)
+}
+
+func writeTestVideo(t *testing.T, fileName string, boxes ...[]byte) {
+	data := testVideoBox("ftyp", []byte("isom"), make([]byte, 4))
+	for _, b := range boxes {
+		data = append(data, b...)
+	}
+	err := os.WriteFile(fileName, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoMeta(t *testing.T) {
+	dir := t.TempDir()
+	created := time.Date(2022, 7, 8, 9, 10, 11, 0, time.UTC)
+	secs := uint64(created.Sub(VIDEO_EPOCH) / time.Second)
+	// The local wall clock held as UTC
+	l := created.Local()
+	wallClock := time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), 0, time.UTC)
+
+	// A portrait phone video. The mdat is before the moov and there is an audio track before the video track
+	fileName := filepath.Join(dir, "clip.MP4")
+	writeTestVideo(t, fileName,
+		testVideoBox("mdat", make([]byte, 1000)),
+		testVideoBox("moov",
+			testVideoMvhd(0, secs, 600, 3300),
+			testVideoBox("trak", testVideoTkhd(0, 0, 0x10000, 0, 0, 0x10000)),
+			testVideoBox("trak", testVideoTkhd(1920, 1080, 0, 0x10000, -0x10000, 0))))
+	pic := NewPicture(fileName, true)
+	if pic.err != nil || pic.video == nil {
+		t.Fatalf("Failed: id:001 %v", pic.err)
+	}
+	if !pic.time.Equal(wallClock) || pic.timeSource != "VIDEO:CreationTime" {
+		t.Fatalf("Failed: id:002 time:%s source:%s", pic.time, pic.timeSource)
+	}
+	if pic.video.width != 1080 || pic.video.height != 1920 || pic.video.rotation != 90 || pic.video.duration != 5500*time.Millisecond {
+		t.Fatalf("Failed: id:003 %+v", pic.video)
+	}
+	js := pictureMeta(pic, NewThumbOptions(200)).String()
+	if !strings.Contains(js, `"video":true`) || !strings.Contains(js, `"duration":5.500`) || !strings.Contains(js, `"rotation":90`) {
+		t.Fatalf("Failed: id:004 %s", js)
+	}
+
+	// Version 1 mvhd with 64 bit times and a 64 bit mdat size
+	fileName = filepath.Join(dir, "clip.mov")
+	mdat := append(binary.BigEndian.AppendUint32(nil, 1), "mdat"...)
+	mdat = binary.BigEndian.AppendUint64(mdat, 16+100)
+	mdat = append(mdat, make([]byte, 100)...)
+	writeTestVideo(t, fileName, mdat, testVideoBox("moov", testVideoMvhd(1, secs, 1000, 2000), testVideoBox("trak", testVideoTkhd(640, 480, 0x10000, 0, 0, 0x10000))))
+	pic = NewPicture(fileName, true)
+	if pic.err != nil || !pic.time.Equal(wallClock) || pic.video.width != 640 || pic.video.height != 480 || pic.video.duration != 2*time.Second {
+		t.Fatalf("Failed: id:005 %v %+v", pic.err, pic.video)
+	}
+
+	// No creation time. The file name is used.
+	fileName = filepath.Join(dir, "VID_20200102_150405.mp4")
+	writeTestVideo(t, fileName, testVideoBox("moov", testVideoMvhd(0, 0, 600, 600)))
+	pic = NewPicture(fileName, true)
+	if pic.err != nil || pic.timeSource == "VIDEO:CreationTime" || pic.time.Format("2006-01-02 15:04:05") != "2020-01-02 15:04:05" {
+		t.Fatalf("Failed: id:006 %v time:%s source:%s", pic.err, pic.time, pic.timeSource)
+	}
+
+	// Not a valid video
+	fileName = filepath.Join(dir, "bad.mp4")
+	os.WriteFile(fileName, []byte("0000moovnot a video"), 0644)
+	pic = NewPicture(fileName, true)
+	if pic.err == nil || pic.video != nil {
+		t.Fatalf("Failed: id:007 an invalid video should have an error")
+	}
+}
+
+func TestVideoThumb(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	created := time.Date(2022, 7, 8, 9, 10, 11, 0, time.UTC)
+	fileName := filepath.Join(srcDir, "clip.mp4")
+	writeTestVideo(t, fileName, testVideoBox("moov", testVideoMvhd(0, uint64(created.Sub(VIDEO_EPOCH)/time.Second), 600, 600)))
+
+	opts := NewThumbOptions(200)
+	if thumb(fileName, dstDir, "%YYYY_%MM_%DD_%n.%x", opts, false, false) != "" {
+		t.Fatalf("Failed: id:001 videos should be skipped by default")
+	}
+	opts.video = VIDEO_COPY
+	copied := thumb(fileName, dstDir, "%YYYY_%MM_%DD_%n.%x", opts, false, false)
+	if copied != filepath.Join(dstDir, created.Local().Format("2006_01_02")+"_clip.mp4") {
+		t.Fatalf("Failed: id:002 copied to '%s'", copied)
+	}
+	a, _ := os.ReadFile(fileName)
+	b, _ := os.ReadFile(copied)
+	if string(a) != string(b) {
+		t.Fatalf("Failed: id:003 the copy is different")
+	}
+	_, err := validVideo("link")
+	if err == nil {
+		t.Fatalf("Failed: id:004 video=link should be invalid")
+	}
+}
+
+//
+// A photo and a video taken a second apart sort and group together whatever the local time zone is.
+//
+func TestVideoPhotoTime(t *testing.T) {
+	defer func(l *time.Location) {
+		time.Local = l
+	}(time.Local)
+	for i, zone := range []*time.Location{time.UTC, time.FixedZone("EST", -5*3600), time.FixedZone("JST", 9*3600)} {
+		time.Local = zone
+		dir := t.TempDir()
+		// The EXIF time is 2021:06:05 10:20:30
+		writeTestRaw(t, filepath.Join(dir, "DSC_0001.NEF"), false)
+		created := time.Date(2021, 6, 5, 10, 20, 31, 0, zone)
+		writeTestVideo(t, filepath.Join(dir, "a.mp4"), testVideoBox("moov", testVideoMvhd(0, uint64(created.Sub(VIDEO_EPOCH)/time.Second), 600, 600)))
+
+		list := []string{"a.mp4", "DSC_0001.NEF"}
+		sortFilesByTime(NewListPictures(dir), list)
+		if strings.Join(list, ",") != "DSC_0001.NEF,a.mp4" {
+			t.Fatalf("Failed: id:%03d zone:%s %v", i*2+1, zone, list)
+		}
+		pics := []*Picture{NewPicture(filepath.Join(dir, "DSC_0001.NEF"), true), NewPicture(filepath.Join(dir, "a.mp4"), true)}
+		groups := groupPictures(pics, NewGroupGaps())
+		if len(groups) != 1 || len(groups[0].bursts) != 1 || groups[0].name != "2021_06_05_10_20" {
+			t.Fatalf("Failed: id:%03d zone:%s groups:%d", i*2+2, zone, len(groups))
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/stuartdd2/JsonParser4go/parser"
+)
+
+const (
+	WATERMARK_ARG       = "watermark="
+	WATERMARK_IMAGE_ARG = "watermarkimage="
+	WM_POSITION_ARG     = "wmposition="
+	WM_OPACITY_ARG      = "wmopacity="
+	WM_SCALE_ARG        = "wmscale="
+	WM_COLOUR_ARG       = "wmcolour="
+
+	WM_TOP_LEFT     = "topleft"
+	WM_TOP_RIGHT    = "topright"
+	WM_BOTTOM_LEFT  = "bottomleft"
+	WM_BOTTOM_RIGHT = "bottomright"
+	WM_CENTRE       = "centre"
+
+	WATERMARK_NAME = "watermark"
+)
+
+var (
+	WATERMARK_PATH = parser.NewDotPath("resources.watermark")
+)
+
+//
+// A text or image (png logo) watermark drawn on thumbnails.
+//
+//    position Where the watermark is drawn. topleft, topright, bottomleft, bottomright or centre.
+//    opacity  0..1. 1 is opaque.
+//    scale    The height of the watermark as a fraction of the short side of the image.
+//    colour   The text colour. The text has a black shadow so it can be read on light images.
+//    full     If true the watermark is also drawn on full size images returned by the server.
+//
+type Watermark struct {
+	text     string
+	logo     image.Image
+	position string
+	opacity  float64
+	scale    float64
+	colour   color.RGBA
+	full     bool
+}
+
+func NewWatermark(text string, logo image.Image) *Watermark {
+	return &Watermark{text: text, logo: logo, position: WM_BOTTOM_RIGHT, opacity: 0.5, scale: 0.06, colour: COLOUR_NAMES["white"], full: false}
+}
+
+//
+// Read the watermark from the command line args. nil if watermark= and watermarkimage= are not given.
+//
+func NewWatermarkFromArgs() (*Watermark, error) {
+	text := findStringArg(WATERMARK_ARG, "")
+	imageFile := findStringArg(WATERMARK_IMAGE_ARG, "")
+	if text == "" && imageFile == "" {
+		return nil, nil
+	}
+	logo, err := loadWatermarkImage(imageFile, "")
+	if err != nil {
+		return nil, err
+	}
+	wm := NewWatermark(text, logo)
+	wm.position, err = validPosition(findStringArg(WM_POSITION_ARG, WM_BOTTOM_RIGHT))
+	if err != nil {
+		return nil, err
+	}
+	wm.opacity, err = validFraction(WM_OPACITY_ARG, findStringArg(WM_OPACITY_ARG, "0.5"))
+	if err != nil {
+		return nil, err
+	}
+	wm.scale, err = validFraction(WM_SCALE_ARG, findStringArg(WM_SCALE_ARG, "0.06"))
+	if err != nil {
+		return nil, err
+	}
+	wm.colour, err = validColour(WM_COLOUR_ARG, findStringArg(WM_COLOUR_ARG, "white"))
+	if err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+//
+// Read a watermark from a config object. A relative image file name is relative to configDir.
+//
+//    "watermark": {"text": "(C) Me", "image": "logo.png", "position": "bottomright", "opacity": 0.5, "scale": 0.06, "colour": "white", "full": true}
+//
+func NewWatermarkFromConfig(obj *parser.JsonObject, configDir string) (*Watermark, error) {
+	text := configString(obj, "text", "")
+	imageFile := configString(obj, "image", "")
+	if text == "" && imageFile == "" {
+		return nil, fmt.Errorf("watermark requires text or image")
+	}
+	logo, err := loadWatermarkImage(imageFile, configDir)
+	if err != nil {
+		return nil, err
+	}
+	wm := NewWatermark(text, logo)
+	wm.position, err = validPosition(configString(obj, "position", WM_BOTTOM_RIGHT))
+	if err != nil {
+		return nil, err
+	}
+	wm.opacity, err = validFraction("opacity=", configValue(obj, "opacity", "0.5"))
+	if err != nil {
+		return nil, err
+	}
+	wm.scale, err = validFraction("scale=", configValue(obj, "scale", "0.06"))
+	if err != nil {
+		return nil, err
+	}
+	wm.colour, err = validColour("colour=", configString(obj, "colour", "white"))
+	if err != nil {
+		return nil, err
+	}
+	wm.full, err = validBool("full=", configValue(obj, "full", "false"))
+	if err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+//
+// The global watermark from the config file (resources.watermark). nil if not defined.
+//
+func watermarkFromConfigData(configData parser.NodeC, configFile string) (*Watermark, error) {
+	node, err := parser.Find(configData, WATERMARK_PATH)
+	if err != nil || node == nil {
+		return nil, nil
+	}
+	obj, ok := node.(*parser.JsonObject)
+	if !ok {
+		return nil, fmt.Errorf("config data node %s is not a json object", WATERMARK_PATH.String())
+	}
+	return NewWatermarkFromConfig(obj, filepath.Dir(configFile))
+}
+
+func loadWatermarkImage(fileName, dir string) (image.Image, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(fileName) && dir != "" {
+		fileName = filepath.Join(dir, fileName)
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("watermark image '%s' %s", fileName, err.Error())
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("watermark image '%s' %s", fileName, err.Error())
+	}
+	return img, nil
+}
+
+func validPosition(position string) (string, error) {
+	p := strings.ToLower(strings.TrimSpace(position))
+	switch p {
+	case "center":
+		return WM_CENTRE, nil
+	case WM_TOP_LEFT, WM_TOP_RIGHT, WM_BOTTOM_LEFT, WM_BOTTOM_RIGHT, WM_CENTRE:
+		return p, nil
+	}
+	return "", fmt.Errorf("position=%s is invalid. Use %s, %s, %s, %s or %s", position, WM_TOP_LEFT, WM_TOP_RIGHT, WM_BOTTOM_LEFT, WM_BOTTOM_RIGHT, WM_CENTRE)
+}
+
+func validFraction(name, value string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || f <= 0 || f > 1 {
+		return 0, fmt.Errorf("%s%s is invalid. Use a number above 0 and up to 1", name, value)
+	}
+	return f, nil
+}
+
+//
+// A short description of the watermark. "none" if nil.
+//
+func (wm *Watermark) String() string {
+	if wm == nil {
+		return "none"
+	}
+	return fmt.Sprintf("text:%s logo:%t position:%s opacity:%g scale:%g colour:%s", wm.text, wm.logo != nil, wm.position, wm.opacity, wm.scale, colourString(wm.colour))
+}
+
+//
+// Draw the watermark on the image. The image is updated and returned.
+// If the watermark is nil the image is returned unchanged.
+//
+func (wm *Watermark) apply(img *image.RGBA) *image.RGBA {
+	if wm == nil {
+		return img
+	}
+	b := img.Bounds()
+	short := minInt(b.Dx(), b.Dy())
+	margin := maxInt(short/50, 2)
+	alpha := uint8(math.Round(wm.opacity * 255))
+
+	if wm.logo != nil {
+		lb := wm.logo.Bounds()
+		lh := maxInt(int(math.Round(float64(short)*wm.scale)), 1)
+		lw := maxInt(int(math.Round(float64(lb.Dx())*float64(lh)/float64(lb.Dy()))), 1)
+		if lw > b.Dx() {
+			lh = maxInt(lh*b.Dx()/lw, 1)
+			lw = b.Dx()
+		}
+		logo := resample(wm.logo, lw, lh, FILTER_CATMULLROM)
+		r := wm.placement(b, lw, lh, margin)
+		draw.DrawMask(img, r, logo, image.Point{}, image.NewUniform(color.Alpha{A: alpha}), image.Point{}, draw.Over)
+	}
+
+	if wm.text != "" {
+		px := maxInt(int(math.Round(float64(short)*wm.scale/FONT_HEIGHT)), 1)
+		mask := textMask(wm.text, px, alpha)
+		mb := mask.Bounds()
+		// Room for the shadow
+		r := wm.placement(b, mb.Dx()+px, mb.Dy()+px, margin)
+		if wm.logo != nil && wm.position != WM_CENTRE {
+			// Move the text towards the centre so it does not overlap the logo
+			r = wm.placement(b, mb.Dx()+px, mb.Dy()+px, margin*2+maxInt(int(math.Round(float64(short)*wm.scale)), 1))
+		}
+		shadow := image.Rect(r.Min.X+px, r.Min.Y+px, r.Min.X+px+mb.Dx(), r.Min.Y+px+mb.Dy())
+		draw.DrawMask(img, shadow, image.NewUniform(color.RGBA{A: 255}), image.Point{}, mask, image.Point{}, draw.Over)
+		text := image.Rect(r.Min.X, r.Min.Y, r.Min.X+mb.Dx(), r.Min.Y+mb.Dy())
+		draw.DrawMask(img, text, image.NewUniform(wm.colour), image.Point{}, mask, image.Point{}, draw.Over)
+	}
+	return img
+}
+
+//
+// The rectangle for a w x h watermark at the position within b. offset is the distance from the edge.
+//
+func (wm *Watermark) placement(b image.Rectangle, w, h, offset int) image.Rectangle {
+	var x, y int
+	switch wm.position {
+	case WM_TOP_LEFT:
+		x, y = b.Min.X+offset, b.Min.Y+offset
+	case WM_TOP_RIGHT:
+		x, y = b.Max.X-offset-w, b.Min.Y+offset
+	case WM_BOTTOM_LEFT:
+		x, y = b.Min.X+offset, b.Max.Y-offset-h
+	case WM_CENTRE:
+		x, y = b.Min.X+(b.Dx()-w)/2, b.Min.Y+(b.Dy()-h)/2
+	default:
+		x, y = b.Max.X-offset-w, b.Max.Y-offset-h
+	}
+	return image.Rect(x, y, x+w, y+h)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTextMask(t *testing.T) {
+	mask := textMask("Ab", 2, 200)
+	if mask.Bounds().Dx() != 22 || mask.Bounds().Dy() != 14 {
+		t.Fatalf("Failed: id:001 size:%dx%d", mask.Bounds().Dx(), mask.Bounds().Dy())
+	}
+	// Top row of 'A' is .###. so x=0 is clear and x=2 (font pixel 1) is set
+	if mask.AlphaAt(0, 0).A != 0 || mask.AlphaAt(2, 0).A != 200 || mask.AlphaAt(3, 1).A != 200 {
+		t.Fatalf("Failed: id:002 'A' top row is wrong")
+	}
+	// 'b' is drawn as 'B'. Top left is set
+	if mask.AlphaAt(12, 0).A != 200 {
+		t.Fatalf("Failed: id:003 'B' top left is not set")
+	}
+	// Unknown characters are '?'
+	if textMask("~", 1, 255).AlphaAt(1, 0) != textMask("?", 1, 255).AlphaAt(1, 0) {
+		t.Fatalf("Failed: id:004 '~' should be drawn as '?'")
+	}
+}
+
+func TestWatermarkApply(t *testing.T) {
+	logo := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for i := range logo.Pix {
+		if i%4 == 0 || i%4 == 3 {
+			logo.Pix[i] = 255
+		}
+	}
+	wm := NewWatermark("", logo)
+	wm.opacity = 1
+	wm.scale = 0.1
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	wm.apply(img)
+	// Logo is 20x10 at margin 2 from the bottom right
+	if img.RGBAAt(190, 90) != (color.RGBA{R: 255, A: 255}) {
+		t.Fatalf("Failed: id:001 logo pixel:%v", img.RGBAAt(190, 90))
+	}
+	if img.RGBAAt(177, 90) != (color.RGBA{}) || img.RGBAAt(10, 10) != (color.RGBA{}) {
+		t.Fatalf("Failed: id:002 pixels outside the logo should not change")
+	}
+
+	wm = NewWatermark("I", nil)
+	wm.position = WM_TOP_LEFT
+	wm.opacity = 1
+	wm.scale = 0.07
+	img = image.NewRGBA(image.Rect(0, 0, 200, 100))
+	wm.apply(img)
+	// px is 1. 'I' top row .###. at margin 2
+	if img.RGBAAt(3, 2) != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Fatalf("Failed: id:003 text pixel:%v", img.RGBAAt(3, 2))
+	}
+	// The shadow is 1 pixel down and right
+	if img.RGBAAt(6, 3) != (color.RGBA{A: 255}) {
+		t.Fatalf("Failed: id:004 shadow pixel:%v", img.RGBAAt(6, 3))
+	}
+
+	var none *Watermark
+	if none.apply(img) != img {
+		t.Fatalf("Failed: id:005 nil watermark should return the image")
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	XMP_JPEG_MARKER = "http://ns.adobe.com/xap/1.0/\x00"
+	XMP_PNG_KEYWORD = "XML:com.adobe.xmp"
+
+	XMP_NS_XMP       = "http://ns.adobe.com/xap/1.0/"
+	XMP_NS_DC        = "http://purl.org/dc/elements/1.1/"
+	XMP_NS_TIFF      = "http://ns.adobe.com/tiff/1.0/"
+	XMP_NS_EXIF      = "http://ns.adobe.com/exif/1.0/"
+	XMP_NS_PHOTOSHOP = "http://ns.adobe.com/photoshop/1.0/"
+	XMP_NS_RDF       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+	XMP_MAX_BYTES = 1024 * 1024 // Sidecars larger than this are ignored
+)
+
+var (
+	// The XMP properties that are read and the names used for them while parsing
+	XMP_PROPERTIES = map[xml.Name]string{
+		{Space: XMP_NS_XMP, Local: "Rating"}:            "Rating",
+		{Space: XMP_NS_XMP, Local: "CreateDate"}:        "CreateDate",
+		{Space: XMP_NS_DC, Local: "title"}:              "title",
+		{Space: XMP_NS_DC, Local: "subject"}:            "subject",
+		{Space: XMP_NS_TIFF, Local: "Orientation"}:      "Orientation",
+		{Space: XMP_NS_EXIF, Local: "DateTimeOriginal"}: "DateTimeOriginal",
+		{Space: XMP_NS_PHOTOSHOP, Local: "DateCreated"}: "DateCreated",
+	}
+
+	// The XMP date properties in the order they are used
+	XMP_TIME_FIELDS = []string{"DateTimeOriginal", "DateCreated", "CreateDate"}
+
+	XMP_TIME_FORMATS = []string{"2006-01-02T15:04:05.999999999Z07:00", "2006-01-02T15:04:05.999999999", "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02"}
+)
+
+//
+// XMP meta data from a sidecar file or embedded in the image.
+//
+//    rating      0 to 5. -1 is rejected. Only valid if hasRating is true.
+//    title       The first dc:title.
+//    keywords    The dc:subject list.
+//    orientation The tiff:Orientation. 0 if not set.
+//    time        The first of exif:DateTimeOriginal, photoshop:DateCreated or xmp:CreateDate. Zero if not set.
+//    timeField   The name of the property the time came from.
+//
+type XmpMeta struct {
+	rating      int
+	hasRating   bool
+	title       string
+	keywords    []string
+	orientation int
+	time        time.Time
+	timeField   string
+}
+
+//
+// Parse an XMP packet. Properties can be attributes of rdf:Description or elements.
+// Element values can be text or a list (rdf:Bag, rdf:Seq or rdf:Alt) of rdf:li values.
+//
+func parseXmp(data []byte) (*XmpMeta, error) {
+	fields := make(map[string][]string)
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	property := ""
+	depth := 0
+	propertyDepth := 0
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("xmp is invalid: %s", err.Error())
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			for _, a := range t.Attr {
+				name, ok := XMP_PROPERTIES[a.Name]
+				if ok {
+					fields[name] = append(fields[name], strings.TrimSpace(a.Value))
+				}
+			}
+			if property == "" {
+				name, ok := XMP_PROPERTIES[t.Name]
+				if ok {
+					property, propertyDepth = name, depth
+				}
+			}
+			text.Reset()
+		case xml.CharData:
+			if property != "" {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if property != "" {
+				v := strings.TrimSpace(text.String())
+				isLi := t.Name.Space == XMP_NS_RDF && t.Name.Local == "li"
+				if isLi || (depth == propertyDepth && v != "") {
+					fields[property] = append(fields[property], v)
+				}
+				text.Reset()
+				if depth == propertyDepth {
+					property = ""
+				}
+			}
+			depth--
+		}
+	}
+	return newXmpMeta(fields), nil
+}
+
+func newXmpMeta(fields map[string][]string) *XmpMeta {
+	x := &XmpMeta{keywords: make([]string, 0)}
+	if v, ok := fields["Rating"]; ok {
+		r, err := strconv.ParseFloat(v[0], 64)
+		if err == nil && r >= -1 && r <= 5 {
+			x.rating, x.hasRating = int(r), true
+		}
+	}
+	if v, ok := fields["title"]; ok {
+		x.title = v[0]
+	}
+	for _, k := range fields["subject"] {
+		if k != "" {
+			x.keywords = append(x.keywords, k)
+		}
+	}
+	if v, ok := fields["Orientation"]; ok {
+		o, err := strconv.Atoi(v[0])
+		if err == nil && o >= 1 && o <= 8 {
+			x.orientation = o
+		}
+	}
+	for _, f := range XMP_TIME_FIELDS {
+		v, ok := fields[f]
+		if !ok {
+			continue
+		}
+		t, err := xmpTimeParse(v[0])
+		if err == nil {
+			x.time, x.timeField = t, f
+			break
+		}
+	}
+	return x
+}
+
+//
+// XMP dates are ISO 8601 and can have a time zone. Like EXIF times the local (wall clock) time is used.
+//
+func xmpTimeParse(s string) (time.Time, error) {
+	for _, f := range XMP_TIME_FORMATS {
+		t, err := time.Parse(f, s)
+		if err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("xmp time '%s' is invalid", s)
+}
+
+//
+// The sidecar for source. Either the name with the suffix replaced (IMG_0001.xmp) or added (IMG_0001.jpg.xmp).
+// Returns "" if there is no sidecar.
+//
+func xmpSidecar(source string) string {
+	base := strings.TrimSuffix(source, filepath.Ext(source))
+	for _, s := range []string{base + ".xmp", base + ".XMP", source + ".xmp", source + ".XMP"} {
+		stat, err := os.Stat(s)
+		if err == nil && !stat.IsDir() {
+			return s
+		}
+	}
+	return ""
+}
+
+func readXmpSidecar(source string) (*XmpMeta, error) {
+	sidecar := xmpSidecar(source)
+	if sidecar == "" {
+		return nil, nil
+	}
+	f, err := os.Open(sidecar)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, XMP_MAX_BYTES))
+	if err != nil {
+		return nil, err
+	}
+	return parseXmp(data)
+}
+
+//
+// Read the XMP packet embedded in a jpg (APP1) or png (iTXt) file. nil if there is no packet.
+//
+func readEmbeddedXmp(source string) (*XmpMeta, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	sig, err := r.Peek(8)
+	if err != nil {
+		return nil, nil
+	}
+	var data []byte
+	if sig[0] == 0xFF && sig[1] == 0xD8 {
+		segs := readJpegSegments(r, 0xE1, XMP_JPEG_MARKER)
+		if len(segs) > 0 {
+			data = segs[0]
+		}
+	} else if string(sig) == "\x89PNG\r\n\x1a\n" {
+		data, err = readPngXmp(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if data == nil {
+		return nil, nil
+	}
+	return parseXmp(data)
+}
+
+//
+// The payload (after prefix) of each jpg segment with the marker before the image data.
+//
+func readJpegSegments(r *bufio.Reader, marker byte, prefix string) [][]byte {
+	r.Discard(2)
+	list := make([][]byte, 0)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return list
+		}
+		if b != 0xFF {
+			continue
+		}
+		m, err := r.ReadByte()
+		if err != nil {
+			return list
+		}
+		if m == 0xFF || m == 0x00 || m == 0x01 || (m >= 0xD0 && m <= 0xD7) {
+			if m == 0xFF {
+				r.UnreadByte()
+			}
+			continue
+		}
+		if m == 0xDA || m == 0xD9 {
+			return list
+		}
+		var length uint16
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err != nil || length < 2 {
+			return list
+		}
+		if m != marker {
+			_, err = r.Discard(int(length) - 2)
+			if err != nil {
+				return list
+			}
+			continue
+		}
+		seg := make([]byte, length-2)
+		_, err = io.ReadFull(r, seg)
+		if err != nil {
+			return list
+		}
+		if strings.HasPrefix(string(seg), prefix) {
+			list = append(list, seg[len(prefix):])
+		}
+	}
+}
+
+//
+// iTXt is keyword, null, compression flag, compression method, language, null, translated keyword, null, text.
+//
+func readPngXmp(r *bufio.Reader) ([]byte, error) {
+	r.Discard(8)
+	for {
+		var length uint32
+		err := binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return nil, nil
+		}
+		typ := make([]byte, 4)
+		_, err = io.ReadFull(r, typ)
+		if err != nil || string(typ) == "IDAT" || string(typ) == "IEND" {
+			return nil, nil
+		}
+		if string(typ) != "iTXt" || length > XMP_MAX_BYTES {
+			_, err = r.Discard(int(length) + 4)
+			if err != nil {
+				return nil, nil
+			}
+			continue
+		}
+		data := make([]byte, length+4)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, nil
+		}
+		data = data[:length]
+		parts := bytes.SplitN(data, []byte{0}, 2)
+		if len(parts) != 2 || string(parts[0]) != XMP_PNG_KEYWORD {
+			continue
+		}
+		rest := parts[1]
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("png iTXt chunk is invalid")
+		}
+		compressed := rest[0] == 1
+		texts := bytes.SplitN(rest[2:], []byte{0}, 3)
+		if len(texts) != 3 {
+			return nil, fmt.Errorf("png iTXt chunk is invalid")
+		}
+		if !compressed {
+			return texts[2], nil
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(texts[2]))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(io.LimitReader(zr, XMP_MAX_BYTES))
+	}
+}
+
+//
+// Read the XMP sidecar and embedded XMP for the picture.
+//
+// A sidecar time or orientation overrides the EXIF values as it is written by editing tools after the picture was taken.
+// An embedded time is only used if there is no EXIF time. Rating, title and keywords come from the sidecar if it has them.
+// Errors are logged and the XMP data is ignored.
+//
+func (p *Picture) applyXmp() {
+	sidecar, err := readXmpSidecar(p.source)
+	if err != nil {
+		logServer("XMP", p.source, err)
+		sidecar = nil
+	}
+	embedded, err := readEmbeddedXmp(p.source)
+	if err != nil {
+		logServer("XMP", p.source, err)
+		embedded = nil
+	}
+	if sidecar == nil && embedded == nil {
+		return
+	}
+	if sidecar != nil && !sidecar.time.IsZero() {
+		p.time, p.timeSource = sidecar.time, "XMP:"+sidecar.timeField
+	} else if embedded != nil && !embedded.time.IsZero() && !strings.HasPrefix(p.timeSource, "EXIF:") {
+		p.time, p.timeSource = embedded.time, "XMP:"+embedded.timeField
+	}
+	if sidecar != nil && sidecar.orientation > 0 && p.video == nil {
+		p.orientation = sidecar.orientation
+	}
+	p.xmp = mergeXmp(sidecar, embedded)
+}
+
+func mergeXmp(sidecar, embedded *XmpMeta) *XmpMeta {
+	if sidecar == nil {
+		return embedded
+	}
+	if embedded == nil {
+		return sidecar
+	}
+	x := *sidecar
+	if !x.hasRating {
+		x.rating, x.hasRating = embedded.rating, embedded.hasRating
+	}
+	if x.title == "" {
+		x.title = embedded.title
+	}
+	if len(x.keywords) == 0 {
+		x.keywords = embedded.keywords
+	}
+	return &x
+}
+
+//
+// Add rating, title and keywords if they are set. x can be nil.
+//
+func (x *XmpMeta) addTo(jf *JsonFields) *JsonFields {
+	if x == nil {
+		return jf
+	}
+	if x.hasRating {
+		jf.AddRaw("rating", fmt.Sprintf("%d", x.rating))
+	}
+	if x.title != "" {
+		jf.Add("title", x.title)
+	}
+	if len(x.keywords) > 0 {
+		list := make([]string, len(x.keywords))
+		for i, k := range x.keywords {
+			list[i] = jsonQuote(k)
+		}
+		jf.AddRaw("keywords", "["+strings.Join(list, ",")+"]")
+	}
+	return jf
+}
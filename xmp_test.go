@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testXmpAttributes = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:tiff="http://ns.adobe.com/tiff/1.0/" xmlns:exif="http://ns.adobe.com/exif/1.0/"
+ xmp:Rating="4" tiff:Orientation="3" exif:DateTimeOriginal="2019-02-03T04:05:06.5+02:00"/>
+</rdf:RDF></x:xmpmeta>`
+
+	testXmpElements = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?><x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/">
+ <xmp:Rating>2</xmp:Rating>
+ <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Beach &amp; Sea</rdf:li></rdf:Alt></dc:title>
+ <dc:subject><rdf:Bag><rdf:li>holiday</rdf:li><rdf:li>beach</rdf:li></rdf:Bag></dc:subject>
+ <photoshop:DateCreated>2018-07-08</photoshop:DateCreated>
+</rdf:Description></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+)
+
+func testXmpImage(t *testing.T) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	return img
+}
+
+func writeTestXmpJpeg(t *testing.T, fileName, xmp string) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testXmpImage(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := append([]byte(XMP_JPEG_MARKER), xmp...)
+	out := append([]byte{}, buf.Bytes()[:2]...)
+	out = append(out, 0xFF, 0xE1, byte((len(seg)+2)>>8), byte(len(seg)+2))
+	out = append(out, seg...)
+	out = append(out, buf.Bytes()[2:]...)
+	err = os.WriteFile(fileName, out, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestXmpPng(t *testing.T, fileName, xmp string) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testXmpImage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte(XMP_PNG_KEYWORD), 0, 0, 0, 0, 0)
+	data = append(data, xmp...)
+	chunk := append([]byte("iTXt"), data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk))
+	chunk = append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), chunk...)
+	// The signature (8) and IHDR (25) are first
+	out := append([]byte{}, buf.Bytes()[:33]...)
+	out = append(out, chunk...)
+	out = append(out, buf.Bytes()[33:]...)
+	err = os.WriteFile(fileName, out, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseXmp(t *testing.T) {
+	x, err := parseXmp([]byte(testXmpAttributes))
+	if err != nil {
+		t.Fatalf("Failed: id:001 %s", err.Error())
+	}
+	if !x.hasRating || x.rating != 4 || x.orientation != 3 || x.timeField != "DateTimeOriginal" || x.time.Format(TIME_FORMAT_MS) != "2019-02-03T04:05:06.500" {
+		t.Fatalf("Failed: id:002 %+v", x)
+	}
+	x, err = parseXmp([]byte(testXmpElements))
+	if err != nil {
+		t.Fatalf("Failed: id:003 %s", err.Error())
+	}
+	if x.rating != 2 || x.title != "Beach & Sea" || strings.Join(x.keywords, ",") != "holiday,beach" || x.orientation != 0 || x.timeField != "DateCreated" {
+		t.Fatalf("Failed: id:004 %+v", x)
+	}
+	js := x.addTo(NewJsonFields()).String()
+	if js != `{"rating":2,"title":"Beach \u0026 Sea","keywords":["holiday","beach"]}` {
+		t.Fatalf("Failed: id:005 %s", js)
+	}
+	_, err = parseXmp([]byte("<x:xmpmeta><rdf:RDF>"))
+	if err == nil {
+		t.Fatalf("Failed: id:006 truncated xmp should fail")
+	}
+	if (*XmpMeta)(nil).addTo(NewJsonFields()).String() != "{}" {
+		t.Fatalf("Failed: id:007 nil xmp should add nothing")
+	}
+}
+
+func TestEmbeddedXmp(t *testing.T) {
+	dir := t.TempDir()
+	for i, fileName := range []string{filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.png")} {
+		if i == 0 {
+			writeTestXmpJpeg(t, fileName, testXmpElements)
+		} else {
+			writeTestXmpPng(t, fileName, testXmpElements)
+		}
+		pic := NewPicture(fileName, true)
+		if pic.xmp == nil || pic.xmp.rating != 2 || len(pic.xmp.keywords) != 2 {
+			t.Fatalf("Failed: id:%03d %+v", i*3+1, pic.xmp)
+		}
+		// There is no EXIF time so the embedded time is used
+		if pic.timeSource != "XMP:DateCreated" || pic.time.Format("2006-01-02") != "2018-07-08" {
+			t.Fatalf("Failed: id:%03d time:%s source:%s", i*3+2, pic.time, pic.timeSource)
+		}
+		_, _, err := image.Decode(mustOpen(t, fileName))
+		if err != nil {
+			t.Fatalf("Failed: id:%03d the image should still decode %s", i*3+3, err.Error())
+		}
+	}
+}
+
+func TestXmpSidecar(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "DSC_0001.NEF")
+	writeTestRaw(t, fileName, false)
+	pic := NewPicture(fileName, true)
+	if pic.orientation != 6 || pic.timeSource != "EXIF:DateTimeOriginal" || pic.xmp != nil {
+		t.Fatalf("Failed: id:001 orientation:%d source:%s", pic.orientation, pic.timeSource)
+	}
+	err := os.WriteFile(filepath.Join(dir, "DSC_0001.xmp"), []byte(testXmpAttributes), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pic = NewPicture(fileName, true)
+	if pic.orientation != 3 || pic.timeSource != "XMP:DateTimeOriginal" || pic.time.Format(TIME_FORMAT_MS) != "2019-02-03T04:05:06.500" {
+		t.Fatalf("Failed: id:002 orientation:%d time:%s source:%s", pic.orientation, pic.time, pic.timeSource)
+	}
+	js := pictureMeta(pic, NewThumbOptions(200)).String()
+	if !strings.Contains(js, `"rating":4`) || !strings.Contains(js, `"orientation":3`) {
+		t.Fatalf("Failed: id:003 %s", js)
+	}
+
+	// A sidecar with the suffix added. The rating comes from the sidecar and the keywords from the embedded xmp.
+	fileName = filepath.Join(dir, "c.jpg")
+	writeTestXmpJpeg(t, fileName, testXmpElements)
+	err = os.WriteFile(fileName+".xmp", []byte(testXmpAttributes), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pic = NewPicture(fileName, true)
+	if pic.xmp.rating != 4 || pic.xmp.title != "Beach & Sea" || len(pic.xmp.keywords) != 2 || pic.orientation != 3 {
+		t.Fatalf("Failed: id:004 %+v orientation:%d", pic.xmp, pic.orientation)
+	}
+	if NewPicture(fileName, false).xmp != nil {
+		t.Fatalf("Failed: id:005 xmp should not be read without thumbnail")
+	}
+}
+
+func mustOpen(t *testing.T, fileName string) *os.File {
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}